@@ -0,0 +1,43 @@
+// This example implements a web server that rejects large request bodies
+// without reading them, for clients that send "Expect: 100-continue".
+//
+// To run: `tinygo run -target=wasip2-http.json ./examples/expect`
+// Test /upload: `curl -v -H 'Expect: 100-continue' --data-binary @large.bin 'http://0.0.0.0:8080/upload'`
+// Test /unread: `curl -v -H 'Expect: 100-continue' --data-binary @large.bin 'http://0.0.0.0:8080/unread'`
+// Test HEAD: `curl -I 'http://0.0.0.0:8080/unread'`
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	_ "github.com/ydnar/wasi-http-go/wasihttp"
+)
+
+const maxUploadSize = 1 << 10
+
+func init() {
+	// /upload reads bodies up to maxUploadSize, and rejects larger bodies
+	// before reading them.
+	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxUploadSize {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "read %d bytes\n", n)
+	})
+
+	// /unread responds without reading the body.
+	http.HandleFunc("/unread", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ignored %d bytes\n", r.ContentLength)
+	})
+}
+
+func main() {}
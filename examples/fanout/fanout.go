@@ -0,0 +1,52 @@
+// This example implements a web server that fans out requests to postman-echo.com
+// concurrently, demonstrating multiple outgoing requests in flight at once.
+// The total time should be close to the slowest request, not the sum.
+//
+// To run: `tinygo run -target=wasip2-http.json ./examples/fanout`
+// Test /: `curl -v 'http://0.0.0.0:8080/'`
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	_ "github.com/ydnar/wasi-http-go/wasihttp"
+)
+
+func init() {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		const n = 5
+		var wg sync.WaitGroup
+		results := make([]string, n)
+		for i := range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t := time.Now()
+				url := fmt.Sprintf("https://postman-echo.com/delay/1?i=%d", i)
+				res, err := http.Get(url)
+				if err != nil {
+					results[i] = fmt.Sprintf("%s: error: %v", url, err)
+					return
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				results[i] = fmt.Sprintf("%s: %s in %s", url, res.Status, time.Since(t))
+			}()
+		}
+		wg.Wait()
+
+		for _, s := range results {
+			fmt.Fprintln(w, s)
+		}
+		fmt.Fprintf(w, "total: %s\n", time.Since(start))
+	})
+}
+
+func main() {}
@@ -8,13 +8,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"time"
 
-	_ "github.com/ydnar/wasi-http-go/wasihttp"
+	"github.com/ydnar/wasi-http-go/wasihttp"
 )
 
 func init() {
@@ -25,6 +26,7 @@ func init() {
 		defer cancel()
 
 		r2 := r.Clone(ctx)
+		r2.RequestURI = "" // http.Client rejects requests with RequestURI set
 		r2.Host = "postman-echo.com"
 		r2.URL.Host = "postman-echo.com"
 		r2.URL.Scheme = "https"
@@ -36,9 +38,15 @@ func init() {
 
 		res, err := http.DefaultClient.Do(r2)
 		if err != nil {
+			log.Printf("error: %v", err)
+			// Propagate wasi-http errors, such as destination-not-found, to the host.
+			var werr *wasihttp.Error
+			if errors.As(err, &werr) {
+				wasihttp.Abort(w, werr)
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error: %v", err)
-			log.Printf("error: %v", err)
 			return
 		}
 
@@ -50,8 +58,13 @@ func init() {
 
 		w.WriteHeader(res.StatusCode)
 		if res.Body != nil {
-			io.Copy(w, res.Body)
+			_, err := io.Copy(w, res.Body)
 			res.Body.Close()
+			if err != nil {
+				// Truncate the response, rather than sending a partial body as complete.
+				log.Printf("error: %v", err)
+				wasihttp.Abort(w, nil)
+			}
 		}
 	})
 }
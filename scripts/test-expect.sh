@@ -0,0 +1,74 @@
+#!/bin/bash
+set -euo pipefail
+
+addr=127.0.0.1:8081
+url="http://$addr"
+
+echo "Building expect example..."
+tinygo build -target=wasip2-http.json -o expect.wasm ./examples/expect
+
+echo "Serving expect example..."
+wasmtime serve -Scli --addr "$addr" expect.wasm &
+server=$!
+large=$(mktemp)
+small=$(mktemp)
+trap 'kill $server 2>/dev/null || true; rm -f "$large" "$small"' EXIT
+head -c 1048576 /dev/zero > "$large"
+echo "hello" > "$small"
+
+for _ in $(seq 50); do
+	if curl -s -o /dev/null "$url/unread"; then
+		break
+	fi
+	sleep 0.1
+done
+
+# request sends a POST with "Expect: 100-continue" and prints the status code.
+# curl waits up to 10s for 100 Continue before sending the body.
+request() {
+	curl -s -o /dev/null -w '%{http_code}' --max-time 30 --expect100-timeout 10 \
+		-H 'Expect: 100-continue' --data-binary "@$1" "$url$2"
+}
+
+# Verify a large body is rejected with 413 without being read
+status=$(request "$large" /upload)
+if [ "$status" != "413" ]; then
+	echo "ERROR: early 413 verification failed: status $status"
+	exit 1
+fi
+
+# Verify a small body is read
+status=$(request "$small" /upload)
+if [ "$status" != "200" ]; then
+	echo "ERROR: small upload verification failed: status $status"
+	exit 1
+fi
+
+# Verify a response is sent without reading the body
+status=$(request "$large" /unread)
+if [ "$status" != "200" ]; then
+	echo "ERROR: unread body verification failed: status $status"
+	exit 1
+fi
+
+# Verify the server still responds after an unread body
+status=$(curl -s -o /dev/null -w '%{http_code}' --max-time 10 "$url/unread")
+if [ "$status" != "200" ]; then
+	echo "ERROR: request after unread body failed: status $status"
+	exit 1
+fi
+
+# Verify a HEAD response, whose body is discarded, is sent without a
+# Content-Length that does not match the empty body sent to the host
+headers=$(curl -s -I --max-time 10 "$url/unread")
+status=$(head -n 1 <<<"$headers" | cut -d ' ' -f 2)
+if [ "$status" != "200" ]; then
+	echo "ERROR: HEAD verification failed: status $status"
+	exit 1
+fi
+if grep -qi '^content-length: [1-9]' <<<"$headers"; then
+	echo "ERROR: HEAD verification failed: non-zero Content-Length"
+	exit 1
+fi
+
+echo "All expect tests passed!"
@@ -0,0 +1,74 @@
+package wasihttp
+
+import (
+	"maps"
+	"sort"
+	"sync"
+)
+
+// Debug enables tracking of the wasi resource handles owned by this package.
+// If true, live handles are counted by resource type, and any handles leaked
+// while serving an incoming request are logged when the request completes.
+// Debug should be set before any requests are served or made.
+var Debug bool
+
+var handles struct {
+	sync.Mutex
+	live map[string]int
+}
+
+// LiveHandles returns the number of live wasi resource handles owned by this
+// package, keyed by resource type, such as "input-stream". It returns nil if
+// [Debug] is false.
+func LiveHandles() map[string]int {
+	if !Debug {
+		return nil
+	}
+	handles.Lock()
+	defer handles.Unlock()
+	return maps.Clone(handles.live)
+}
+
+// track records the creation of a resource handle of type kind.
+func track(kind string) {
+	if !Debug {
+		return
+	}
+	handles.Lock()
+	defer handles.Unlock()
+	if handles.live == nil {
+		handles.live = make(map[string]int)
+	}
+	handles.live[kind]++
+}
+
+// untrack records the release of a resource handle of type kind.
+func untrack(kind string) {
+	if !Debug {
+		return
+	}
+	handles.Lock()
+	defer handles.Unlock()
+	if handles.live[kind] <= 0 {
+		return // created before Debug was set
+	}
+	handles.live[kind]--
+	if handles.live[kind] == 0 {
+		delete(handles.live, kind)
+	}
+}
+
+// reportLeaks logs any handles that are live now, but were not in before.
+func reportLeaks(what string, before map[string]int) {
+	after := LiveHandles()
+	kinds := make([]string, 0, len(after))
+	for kind := range after {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		if n := after[kind] - before[kind]; n > 0 {
+			logf("wasihttp: %s leaked %d %s handle(s)", what, n, kind)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDebugLeaks(t *testing.T) {
+	h := newFakeHost(t)
+	setVar(t, &Debug, true)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	var leaked *bodyReader
+	s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read a body without finishing it.
+		leaked = newBodyReader(h.IncomingBody(&fakePipe{buf: []byte("leak")}, nil), func(http.Header) {})
+		leaked.ReadByte()
+		w.Write([]byte("ok"))
+	})}
+	before := LiveHandles()
+	res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+	if res.Body != "ok" {
+		t.Errorf("got body %q, expected %q", res.Body, "ok")
+	}
+	if got, want := buf.String(), "wasihttp: request leaked 1 input-stream handle(s)"; !strings.Contains(got, want) {
+		t.Errorf("got log %q, expected %q", got, want)
+	}
+	if strings.Count(buf.String(), "leaked") != 1 {
+		t.Errorf("got log %q, expected a single leak", buf.String())
+	}
+	if n := LiveHandles()["input-stream"] - before["input-stream"]; n != 1 {
+		t.Errorf("got %d live input-stream handles, expected 1", n)
+	}
+	leaked.Close()
+	if n := LiveHandles()["input-stream"] - before["input-stream"]; n != 0 {
+		t.Errorf("got %d live input-stream handles after Close, expected 0", n)
+	}
+}
+
+// TestDebugLate tests that handles created before Debug is set can be
+// released after it is set.
+func TestDebugLate(t *testing.T) {
+	h := newFakeHost(t)
+	setVar(t, &Debug, false)
+	r := newBodyReader(h.IncomingBody(&fakePipe{buf: []byte("x")}, nil), func(http.Header) {})
+	r.ReadByte()
+	Debug = true
+	r.Close()
+	for kind, n := range LiveHandles() {
+		if n < 0 {
+			t.Errorf("got %d live %s handles", n, kind)
+		}
+	}
+}
+
+// TestStreamErrorDropped tests that the wasi:io/error of a failed write is
+// reported and dropped.
+func TestStreamErrorDropped(t *testing.T) {
+	h := newFakeHost(t)
+	setVar(t, &Debug, true)
+	live := Live[*fakeIOError](h)
+	pipe := &fakePipe{fail: true}
+	body, _ := h.OutgoingBody(pipe)
+	w := newBodyWriter(body, 0, nil)
+	_, err := w.Write(make([]byte, 2*defaultBufferSize))
+	if err == nil || !strings.Contains(err.Error(), "last-operation-failed: write failed") {
+		t.Errorf("got %v, expected the write error", err)
+	}
+	w.abort()
+	if n := Live[*fakeIOError](h) - live; n != 0 {
+		t.Errorf("got %d live io-error resources, expected 0", n)
+	}
+	if n := LiveHandles()["io-error"]; n != 0 {
+		t.Errorf("got %d tracked io-error handles, expected 0", n)
+	}
+}
@@ -0,0 +1,283 @@
+package wasihttp
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	"go.bytecodealliance.org/cm"
+)
+
+var _ net.Error = &Error{}
+
+// Error is a [wasi-http] error-code, returned by the host when an HTTP
+// request or response fails. Use [errors.Is] with one of the Err* values to
+// test for a specific error-code, or [errors.As] to access its payload.
+//
+// [wasi-http]: https://github.com/webassembly/wasi-http
+type Error struct {
+	code types.ErrorCode
+}
+
+// Errors for each wasi-http error-code case. An [Error] matches one of these
+// with [errors.Is] if it has the same case, regardless of its payload.
+var (
+	ErrDNSTimeout                     = &Error{types.ErrorCodeDNSTimeout()}
+	ErrDNSError                       = &Error{types.ErrorCodeDNSError(types.DNSErrorPayload{})}
+	ErrDestinationNotFound            = &Error{types.ErrorCodeDestinationNotFound()}
+	ErrDestinationUnavailable         = &Error{types.ErrorCodeDestinationUnavailable()}
+	ErrDestinationIPProhibited        = &Error{types.ErrorCodeDestinationIPProhibited()}
+	ErrDestinationIPUnroutable        = &Error{types.ErrorCodeDestinationIPUnroutable()}
+	ErrConnectionRefused              = &Error{types.ErrorCodeConnectionRefused()}
+	ErrConnectionTerminated           = &Error{types.ErrorCodeConnectionTerminated()}
+	ErrConnectionTimeout              = &Error{types.ErrorCodeConnectionTimeout()}
+	ErrConnectionReadTimeout          = &Error{types.ErrorCodeConnectionReadTimeout()}
+	ErrConnectionWriteTimeout         = &Error{types.ErrorCodeConnectionWriteTimeout()}
+	ErrConnectionLimitReached         = &Error{types.ErrorCodeConnectionLimitReached()}
+	ErrTLSProtocolError               = &Error{types.ErrorCodeTLSProtocolError()}
+	ErrTLSCertificateError            = &Error{types.ErrorCodeTLSCertificateError()}
+	ErrTLSAlertReceived               = &Error{types.ErrorCodeTLSAlertReceived(types.TLSAlertReceivedPayload{})}
+	ErrHTTPRequestDenied              = &Error{types.ErrorCodeHTTPRequestDenied()}
+	ErrHTTPRequestLengthRequired      = &Error{types.ErrorCodeHTTPRequestLengthRequired()}
+	ErrHTTPRequestBodySize            = &Error{types.ErrorCodeHTTPRequestBodySize(cm.None[uint64]())}
+	ErrHTTPRequestMethodInvalid       = &Error{types.ErrorCodeHTTPRequestMethodInvalid()}
+	ErrHTTPRequestURIInvalid          = &Error{types.ErrorCodeHTTPRequestURIInvalid()}
+	ErrHTTPRequestURITooLong          = &Error{types.ErrorCodeHTTPRequestURITooLong()}
+	ErrHTTPRequestHeaderSectionSize   = &Error{types.ErrorCodeHTTPRequestHeaderSectionSize(cm.None[uint32]())}
+	ErrHTTPRequestHeaderSize          = &Error{types.ErrorCodeHTTPRequestHeaderSize(cm.None[types.FieldSizePayload]())}
+	ErrHTTPRequestTrailerSectionSize  = &Error{types.ErrorCodeHTTPRequestTrailerSectionSize(cm.None[uint32]())}
+	ErrHTTPRequestTrailerSize         = &Error{types.ErrorCodeHTTPRequestTrailerSize(types.FieldSizePayload{})}
+	ErrHTTPResponseIncomplete         = &Error{types.ErrorCodeHTTPResponseIncomplete()}
+	ErrHTTPResponseHeaderSectionSize  = &Error{types.ErrorCodeHTTPResponseHeaderSectionSize(cm.None[uint32]())}
+	ErrHTTPResponseHeaderSize         = &Error{types.ErrorCodeHTTPResponseHeaderSize(types.FieldSizePayload{})}
+	ErrHTTPResponseBodySize           = &Error{types.ErrorCodeHTTPResponseBodySize(cm.None[uint64]())}
+	ErrHTTPResponseTrailerSectionSize = &Error{types.ErrorCodeHTTPResponseTrailerSectionSize(cm.None[uint32]())}
+	ErrHTTPResponseTrailerSize        = &Error{types.ErrorCodeHTTPResponseTrailerSize(types.FieldSizePayload{})}
+	ErrHTTPResponseTransferCoding     = &Error{types.ErrorCodeHTTPResponseTransferCoding(cm.None[string]())}
+	ErrHTTPResponseContentCoding      = &Error{types.ErrorCodeHTTPResponseContentCoding(cm.None[string]())}
+	ErrHTTPResponseTimeout            = &Error{types.ErrorCodeHTTPResponseTimeout()}
+	ErrHTTPUpgradeFailed              = &Error{types.ErrorCodeHTTPUpgradeFailed()}
+	ErrHTTPProtocolError              = &Error{types.ErrorCodeHTTPProtocolError()}
+	ErrLoopDetected                   = &Error{types.ErrorCodeLoopDetected()}
+	ErrConfigurationError             = &Error{types.ErrorCodeConfigurationError()}
+	ErrInternalError                  = &Error{types.ErrorCodeInternalError(cm.None[string]())}
+)
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	var details []string
+	add := func(k, v string) {
+		details = append(details, k+"="+v)
+	}
+	if s, ok := e.DNSRcode(); ok {
+		add("rcode", s)
+	}
+	if n, ok := e.DNSInfoCode(); ok {
+		add("info-code", strconv.FormatUint(uint64(n), 10))
+	}
+	if n, ok := e.TLSAlertID(); ok {
+		add("alert-id", strconv.FormatUint(uint64(n), 10))
+	}
+	if s, ok := e.TLSAlertMessage(); ok {
+		add("alert-message", strconv.Quote(s))
+	}
+	if s, ok := e.FieldName(); ok {
+		add("field-name", s)
+	}
+	if n, ok := e.FieldSize(); ok {
+		add("field-size", strconv.FormatUint(uint64(n), 10))
+	}
+	if n, ok := e.SectionSize(); ok {
+		add("size", strconv.FormatUint(uint64(n), 10))
+	}
+	if n, ok := e.BodySize(); ok {
+		add("size", strconv.FormatUint(n, 10))
+	}
+	s := "wasihttp: " + e.code.String()
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, " ") + ")"
+	}
+	if msg, ok := e.Message(); ok {
+		s += ": " + msg
+	}
+	return s
+}
+
+// Is reports whether e matches target. An [Error] matches another [Error]
+// with the same error-code case. An [Error] for which Timeout returns true
+// matches [os.ErrDeadlineExceeded].
+func (e *Error) Is(target error) bool {
+	if target == os.ErrDeadlineExceeded {
+		return e.Timeout()
+	}
+	t, ok := target.(*Error)
+	return ok && t.code.Tag() == e.code.Tag()
+}
+
+// Timeout reports whether e represents a timeout.
+// It implements [net.Error].
+func (e *Error) Timeout() bool {
+	c := &e.code
+	return c.DNSTimeout() ||
+		c.ConnectionTimeout() ||
+		c.ConnectionReadTimeout() ||
+		c.ConnectionWriteTimeout() ||
+		c.HTTPResponseTimeout()
+}
+
+// Temporary reports whether e represents a timeout.
+// It implements [net.Error].
+//
+// Deprecated: Temporary errors are not well-defined. Use Timeout instead.
+func (e *Error) Temporary() bool {
+	return e.Timeout()
+}
+
+// Code returns the wasi-http error-code case name, e.g. "connection-refused".
+func (e *Error) Code() string {
+	return e.code.String()
+}
+
+// DNSRcode returns the DNS rcode of a DNS-error, if present.
+func (e *Error) DNSRcode() (string, bool) {
+	if p := e.code.DNSError(); p != nil {
+		return optionValue(p.Rcode)
+	}
+	return "", false
+}
+
+// DNSInfoCode returns the DNS info-code of a DNS-error, if present.
+func (e *Error) DNSInfoCode() (uint16, bool) {
+	if p := e.code.DNSError(); p != nil {
+		return optionValue(p.InfoCode)
+	}
+	return 0, false
+}
+
+// TLSAlertID returns the alert-id of a TLS-alert-received error, if present.
+func (e *Error) TLSAlertID() (uint8, bool) {
+	if p := e.code.TLSAlertReceived(); p != nil {
+		return optionValue(p.AlertID)
+	}
+	return 0, false
+}
+
+// TLSAlertMessage returns the alert-message of a TLS-alert-received error, if present.
+func (e *Error) TLSAlertMessage() (string, bool) {
+	if p := e.code.TLSAlertReceived(); p != nil {
+		return optionValue(p.AlertMessage)
+	}
+	return "", false
+}
+
+// FieldName returns the name of the header or trailer field
+// that exceeded a size limit, if present.
+func (e *Error) FieldName() (string, bool) {
+	if p, ok := e.fieldSizePayload(); ok {
+		return optionValue(p.FieldName)
+	}
+	return "", false
+}
+
+// FieldSize returns the size of the header or trailer field
+// that exceeded a size limit, if present.
+func (e *Error) FieldSize() (uint32, bool) {
+	if p, ok := e.fieldSizePayload(); ok {
+		return optionValue(p.FieldSize)
+	}
+	return 0, false
+}
+
+func (e *Error) fieldSizePayload() (types.FieldSizePayload, bool) {
+	c := &e.code
+	if o := c.HTTPRequestHeaderSize(); o != nil {
+		return optionValue(*o)
+	}
+	for _, p := range []*types.FieldSizePayload{
+		c.HTTPRequestTrailerSize(),
+		c.HTTPResponseHeaderSize(),
+		c.HTTPResponseTrailerSize(),
+	} {
+		if p != nil {
+			return *p, true
+		}
+	}
+	return types.FieldSizePayload{}, false
+}
+
+// SectionSize returns the size of the header or trailer section
+// that exceeded a size limit, if present.
+func (e *Error) SectionSize() (uint32, bool) {
+	c := &e.code
+	for _, o := range []*cm.Option[uint32]{
+		c.HTTPRequestHeaderSectionSize(),
+		c.HTTPRequestTrailerSectionSize(),
+		c.HTTPResponseHeaderSectionSize(),
+		c.HTTPResponseTrailerSectionSize(),
+	} {
+		if o != nil {
+			return optionValue(*o)
+		}
+	}
+	return 0, false
+}
+
+// BodySize returns the size of the request or response body
+// that exceeded a size limit, if present.
+func (e *Error) BodySize() (uint64, bool) {
+	c := &e.code
+	if o := c.HTTPRequestBodySize(); o != nil {
+		return optionValue(*o)
+	}
+	if o := c.HTTPResponseBodySize(); o != nil {
+		return optionValue(*o)
+	}
+	return 0, false
+}
+
+// Message returns the message of an internal-error, or the coding of an
+// HTTP-response-transfer-coding or HTTP-response-content-coding error, if present.
+func (e *Error) Message() (string, bool) {
+	c := &e.code
+	for _, o := range []*cm.Option[string]{
+		c.HTTPResponseTransferCoding(),
+		c.HTTPResponseContentCoding(),
+		c.InternalError(),
+	} {
+		if o != nil {
+			return optionValue(*o)
+		}
+	}
+	return "", false
+}
+
+// HeaderError is returned when the host rejects one or more HTTP header or
+// trailer fields. Hop-by-hop fields such as Connection and Keep-Alive are
+// removed before sending and are not reported.
+type HeaderError struct {
+	Fields []FieldError // sorted by Name
+}
+
+// FieldError describes a single header field rejected by the host.
+type FieldError struct {
+	Name   string
+	Reason string // "invalid-syntax", "forbidden", or "immutable"
+}
+
+func (e *HeaderError) Error() string {
+	fields := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		fields[i] = f.Name + " (" + f.Reason + ")"
+	}
+	return "wasihttp: rejected header fields: " + strings.Join(fields, ", ")
+}
+
+func optionValue[T any](o cm.Option[T]) (T, bool) {
+	if v := o.Some(); v != nil {
+		return *v, true
+	}
+	var zero T
+	return zero, false
+}
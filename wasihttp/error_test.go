@@ -0,0 +1,167 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	"go.bytecodealliance.org/cm"
+)
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		err    error
+		target error
+		want   bool
+	}{
+		{ErrConnectionRefused, ErrConnectionRefused, true},
+		{ErrConnectionRefused, ErrConnectionTerminated, false},
+		{&Error{types.ErrorCodeInternalError(cm.Some("boom"))}, ErrInternalError, true},
+		{&Error{types.ErrorCodeHTTPRequestBodySize(cm.Some[uint64](10))}, ErrHTTPRequestBodySize, true},
+		{&Error{types.ErrorCodeHTTPRequestBodySize(cm.Some[uint64](10))}, ErrHTTPResponseBodySize, false},
+		{&Error{types.ErrorCodeDNSError(types.DNSErrorPayload{Rcode: cm.Some("NXDOMAIN")})}, ErrDNSError, true},
+		{fmt.Errorf("wrapped: %w", ErrHTTPProtocolError), ErrHTTPProtocolError, true},
+		{ErrDNSTimeout, os.ErrDeadlineExceeded, true},
+		{ErrConnectionTimeout, os.ErrDeadlineExceeded, true},
+		{ErrConnectionReadTimeout, os.ErrDeadlineExceeded, true},
+		{ErrConnectionWriteTimeout, os.ErrDeadlineExceeded, true},
+		{ErrHTTPResponseTimeout, os.ErrDeadlineExceeded, true},
+		{ErrConnectionRefused, os.ErrDeadlineExceeded, false},
+		{ErrHTTPResponseTimeout, context.DeadlineExceeded, false},
+		{ErrConnectionRefused, errors.New("connection-refused"), false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v/%v", tt.err, tt.target), func(t *testing.T) {
+			if got := errors.Is(tt.err, tt.target); got != tt.want {
+				t.Errorf("errors.Is: got %t, expected %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorTimeout(t *testing.T) {
+	timeouts := map[*Error]bool{
+		ErrDNSTimeout:             true,
+		ErrConnectionTimeout:      true,
+		ErrConnectionReadTimeout:  true,
+		ErrConnectionWriteTimeout: true,
+		ErrHTTPResponseTimeout:    true,
+		ErrConnectionRefused:      false,
+		ErrHTTPProtocolError:      false,
+		ErrInternalError:          false,
+	}
+	for e, want := range timeouts {
+		var ne net.Error
+		if !errors.As(error(e), &ne) {
+			t.Fatalf("%v does not implement net.Error", e)
+		}
+		if got := ne.Timeout(); got != want {
+			t.Errorf("%v: Timeout() = %t, expected %t", e, got, want)
+		}
+	}
+}
+
+func TestErrorPayload(t *testing.T) {
+	fieldSize := types.FieldSizePayload{
+		FieldName: cm.Some("x-large"),
+		FieldSize: cm.Some[uint32](9000),
+	}
+	tests := []struct {
+		code types.ErrorCode
+		want string
+		get  func(*Error) (any, bool)
+		val  any
+	}{
+		{
+			code: types.ErrorCodeDNSError(types.DNSErrorPayload{Rcode: cm.Some("NXDOMAIN"), InfoCode: cm.Some[uint16](3)}),
+			want: "wasihttp: DNS-error (rcode=NXDOMAIN info-code=3)",
+			get:  func(e *Error) (any, bool) { return e.DNSRcode() },
+			val:  "NXDOMAIN",
+		},
+		{
+			code: types.ErrorCodeDNSError(types.DNSErrorPayload{InfoCode: cm.Some[uint16](3)}),
+			want: "wasihttp: DNS-error (info-code=3)",
+			get:  func(e *Error) (any, bool) { return e.DNSInfoCode() },
+			val:  uint16(3),
+		},
+		{
+			code: types.ErrorCodeTLSAlertReceived(types.TLSAlertReceivedPayload{AlertID: cm.Some[uint8](42), AlertMessage: cm.Some("bad certificate")}),
+			want: `wasihttp: TLS-alert-received (alert-id=42 alert-message="bad certificate")`,
+			get:  func(e *Error) (any, bool) { return e.TLSAlertMessage() },
+			val:  "bad certificate",
+		},
+		{
+			code: types.ErrorCodeTLSAlertReceived(types.TLSAlertReceivedPayload{AlertID: cm.Some[uint8](42)}),
+			want: "wasihttp: TLS-alert-received (alert-id=42)",
+			get:  func(e *Error) (any, bool) { return e.TLSAlertID() },
+			val:  uint8(42),
+		},
+		{
+			code: types.ErrorCodeHTTPRequestHeaderSize(cm.Some(fieldSize)),
+			want: "wasihttp: HTTP-request-header-size (field-name=x-large field-size=9000)",
+			get:  func(e *Error) (any, bool) { return e.FieldName() },
+			val:  "x-large",
+		},
+		{
+			code: types.ErrorCodeHTTPRequestHeaderSize(cm.None[types.FieldSizePayload]()),
+			want: "wasihttp: HTTP-request-header-size",
+			get:  func(e *Error) (any, bool) { return e.FieldName() },
+		},
+		{
+			code: types.ErrorCodeHTTPResponseTrailerSize(fieldSize),
+			want: "wasihttp: HTTP-response-trailer-size (field-name=x-large field-size=9000)",
+			get:  func(e *Error) (any, bool) { return e.FieldSize() },
+			val:  uint32(9000),
+		},
+		{
+			code: types.ErrorCodeHTTPResponseHeaderSectionSize(cm.Some[uint32](65536)),
+			want: "wasihttp: HTTP-response-header-section-size (size=65536)",
+			get:  func(e *Error) (any, bool) { return e.SectionSize() },
+			val:  uint32(65536),
+		},
+		{
+			code: types.ErrorCodeHTTPResponseBodySize(cm.Some[uint64](1 << 20)),
+			want: "wasihttp: HTTP-response-body-size (size=1048576)",
+			get:  func(e *Error) (any, bool) { return e.BodySize() },
+			val:  uint64(1 << 20),
+		},
+		{
+			code: types.ErrorCodeHTTPResponseContentCoding(cm.Some("br")),
+			want: "wasihttp: HTTP-response-content-coding: br",
+			get:  func(e *Error) (any, bool) { return e.Message() },
+			val:  "br",
+		},
+		{
+			code: types.ErrorCodeInternalError(cm.Some("boom")),
+			want: "wasihttp: internal-error: boom",
+			get:  func(e *Error) (any, bool) { return e.Message() },
+			val:  "boom",
+		},
+		{
+			code: types.ErrorCodeConnectionRefused(),
+			want: "wasihttp: connection-refused",
+			get:  func(e *Error) (any, bool) { return e.Message() },
+		},
+	}
+	for _, tt := range tests {
+		e := &Error{tt.code}
+		t.Run(e.Code(), func(t *testing.T) {
+			if got := e.Error(); got != tt.want {
+				t.Errorf("Error(): got %q, expected %q", got, tt.want)
+			}
+			v, ok := tt.get(e)
+			if ok != (tt.val != nil) {
+				t.Fatalf("accessor: got ok=%t, expected %t", ok, tt.val != nil)
+			}
+			if ok && v != tt.val {
+				t.Errorf("accessor: got %#v, expected %#v", v, tt.val)
+			}
+		})
+	}
+}
@@ -0,0 +1,1176 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	monotonicclock "github.com/ydnar/wasi-http-go/internal/wasi/clocks/monotonic-clock"
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	ioerror "github.com/ydnar/wasi-http-go/internal/wasi/io/error"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/poll"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/streams"
+	"go.bytecodealliance.org/cm"
+)
+
+// This file implements a fake wasi-http host, so tests can run without a
+// WebAssembly runtime. The generated bindings in internal/wasi declare their
+// host functions without bodies. The functions at the end of this file
+// provide them with go:linkname, so tests exercise the real bindings.
+// Only the host functions used by this package are implemented.
+// Tests can also replace the outgoingHandle and pollAll variables to
+// observe or intercept calls to the host.
+
+// host is the fake host. Its resources are shared by all tests;
+// configure it for a single test with [newFakeHost].
+var host = &fakeHost{
+	resources: make(map[uint32]any),
+	calls:     make(map[string]int),
+}
+
+type fakeHost struct {
+	mu        sync.Mutex
+	next      uint32
+	resources map[uint32]any
+	calls     map[string]int // host calls by function name
+
+	// Configuration, reset by newFakeHost.
+	forbidden   map[string]bool // lower-case header names rejected as forbidden
+	writeBudget int             // check-write budget, 0 means 64KB
+	handleErr   *types.ErrorCode
+	noOptions   map[string]bool // request-options not supported: "connect", "first-byte", or "between-bytes"
+	onRequest   func(req *fakeOutgoingRequest, f *fakeFuture)
+	onPoll      func(pollables []*fakePollable)
+}
+
+// newFakeHost resets the configuration of the fake host for the current test.
+func newFakeHost(tb testing.TB) *fakeHost {
+	h := host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = make(map[string]int)
+	h.forbidden = nil
+	h.writeBudget = 0
+	h.handleErr = nil
+	h.noOptions = nil
+	h.onRequest = nil
+	h.onPoll = nil
+	return h
+}
+
+// count records a call to the host function name. The caller must hold h.mu.
+func (h *fakeHost) count(name string) {
+	h.calls[name]++
+}
+
+// Calls returns the number of calls to host functions with prefix.
+func (h *fakeHost) Calls(prefix string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	for name, c := range h.calls {
+		if strings.HasPrefix(name, prefix) {
+			n += c
+		}
+	}
+	return n
+}
+
+// Live returns the number of live resources of type T.
+func Live[T any](h *fakeHost) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	for _, v := range h.resources {
+		if _, ok := v.(T); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// add adds resource v, returning its handle. The caller must hold h.mu.
+func (h *fakeHost) add(v any) uint32 {
+	h.next++
+	h.resources[h.next] = v
+	return h.next
+}
+
+// take removes the resource with handle from h, returning it.
+// The caller must hold h.mu.
+func take[T any](h *fakeHost, handle uint32) T {
+	v := get[T](h, handle)
+	delete(h.resources, handle)
+	return v
+}
+
+// get returns the resource with handle. The caller must hold h.mu.
+func get[T any](h *fakeHost, handle uint32) T {
+	v, ok := h.resources[handle].(T)
+	if !ok {
+		panic("fake host: invalid handle")
+	}
+	return v
+}
+
+// fakeFields is a wasi-http fields resource.
+type fakeFields struct {
+	header http.Header
+}
+
+// fieldsHandle returns a new fields resource with a copy of header.
+// The caller must hold h.mu.
+func (h *fakeHost) fieldsHandle(header http.Header) uint32 {
+	return h.add(&fakeFields{header.Clone()})
+}
+
+// fakePollable is a wasi pollable, ready when ready returns true.
+// Functions are called with host.mu held.
+type fakePollable struct {
+	ready func() bool
+	clock time.Duration // non-zero for monotonic-clock pollables
+}
+
+// fakePipe is the data of a stream, shared by its reader and writer.
+type fakePipe struct {
+	buf     []byte
+	closed  bool // the writer is done, so readers see EOF once buf is drained
+	dropped bool // the reader is gone, so writes fail with closed
+	fail    bool // writes fail with last-operation-failed
+	limit   int  // if positive, the maximum number of buffered bytes
+	discard bool // written data is counted in n, but not buffered
+	size    int  // if positive, the reader is dropped once size bytes are written
+	n       int  // total bytes written
+}
+
+// written counts n bytes written to pipe. The caller must hold host.mu.
+func (pipe *fakePipe) written(n int) {
+	pipe.n += n
+	if pipe.size > 0 && pipe.n >= pipe.size {
+		pipe.dropped = true
+	}
+}
+
+type fakeInputStream struct{ pipe *fakePipe }
+type fakeOutputStream struct{ pipe *fakePipe }
+type fakeIOError struct{ msg string }
+
+// fakeIncomingBody is a request body sent to the guest, or a response body
+// received by the guest.
+type fakeIncomingBody struct {
+	pipe     *fakePipe
+	trailers http.Header
+	streamed bool
+}
+
+type fakeFutureTrailers struct{ body *fakeIncomingBody }
+
+// fakeOutgoingBody is a body written by the guest.
+type fakeOutgoingBody struct {
+	pipe     *fakePipe
+	written  bool
+	finished bool // finished by the guest
+	aborted  bool // dropped without being finished
+	trailers http.Header
+}
+
+type fakeIncomingRequest struct {
+	method, scheme, authority, path string
+	header                          http.Header
+	body                            *fakeIncomingBody
+	consumed                        bool
+}
+
+type fakeOutparam struct {
+	set      bool
+	response *fakeOutgoingResponse
+	errTag   int // error-code case, or -1 if a response was set
+}
+
+type fakeOutgoingResponse struct {
+	status int
+	header http.Header
+	body   *fakeOutgoingBody
+}
+
+type fakeOutgoingRequest struct {
+	method, scheme, authority, path string
+	header                          http.Header
+	body                            *fakeOutgoingBody
+	options                         *fakeRequestOptions
+}
+
+type fakeRequestOptions struct {
+	connect, firstByte, betweenBytes time.Duration
+}
+
+// fakeFuture is a future-incoming-response, resolved by respond or fail.
+type fakeFuture struct {
+	res     *fakeIncomingResponse
+	err     *types.ErrorCode
+	done    bool
+	taken   bool
+	dropped bool
+}
+
+type fakeIncomingResponse struct {
+	status   int
+	header   http.Header
+	body     *fakeIncomingBody
+	consumed bool
+}
+
+// Request returns a new incoming-request for the guest, with the method,
+// URL, and header of req, and a body containing req.Body.
+func (h *fakeHost) Request(req *http.Request) (types.IncomingRequest, *fakeIncomingRequest) {
+	pipe := &fakePipe{closed: true}
+	if req.Body != nil {
+		pipe.buf, _ = io.ReadAll(req.Body)
+	}
+	return h.StreamingRequest(req, pipe)
+}
+
+// StreamingRequest is like Request, but with a body read from pipe.
+func (h *fakeHost) StreamingRequest(req *http.Request, pipe *fakePipe) (types.IncomingRequest, *fakeIncomingRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := &fakeIncomingRequest{
+		method:    req.Method,
+		scheme:    req.URL.Scheme,
+		authority: req.Host,
+		path:      req.URL.RequestURI(),
+		header:    req.Header.Clone(),
+		body:      &fakeIncomingBody{pipe: pipe},
+	}
+	if r.scheme == "" {
+		r.scheme = "http"
+	}
+	return types.IncomingRequest(h.add(r)), r
+}
+
+// Outparam returns a new response-outparam for the guest.
+func (h *fakeHost) Outparam() (types.ResponseOutparam, *fakeOutparam) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	o := &fakeOutparam{errTag: -1}
+	return types.ResponseOutparam(h.add(o)), o
+}
+
+// Pollable returns a new pollable, ready when ready returns true.
+// The ready function is called with h.mu held.
+func (h *fakeHost) Pollable(ready func() bool) poll.Pollable {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return poll.Pollable(h.add(&fakePollable{ready: ready}))
+}
+
+// IncomingBody returns a new incoming-body for the guest, read from pipe,
+// with optional trailers.
+func (h *fakeHost) IncomingBody(pipe *fakePipe, trailers http.Header) types.IncomingBody {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return types.IncomingBody(h.add(&fakeIncomingBody{pipe: pipe, trailers: trailers}))
+}
+
+// OutgoingBody returns a new outgoing-body for the guest, written to pipe.
+func (h *fakeHost) OutgoingBody(pipe *fakePipe) (types.OutgoingBody, *fakeOutgoingBody) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := &fakeOutgoingBody{pipe: pipe}
+	return types.OutgoingBody(h.add(b)), b
+}
+
+// Write writes p to pipe.
+func (h *fakeHost) Write(pipe *fakePipe, p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pipe.buf = append(pipe.buf, p...)
+}
+
+// Close closes pipe, so its reader sees EOF.
+func (h *fakeHost) Close(pipe *fakePipe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pipe.closed = true
+}
+
+// Drop drops the reader of pipe, so subsequent writes fail with closed.
+func (h *fakeHost) Drop(pipe *fakePipe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pipe.dropped = true
+}
+
+// Fail makes subsequent writes to pipe fail with last-operation-failed.
+func (h *fakeHost) Fail(pipe *fakePipe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pipe.fail = true
+}
+
+// Read removes and returns the data buffered in pipe, and reports whether
+// its writer is done.
+func (h *fakeHost) Read(pipe *fakePipe) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := pipe.buf
+	pipe.buf = nil
+	return p, pipe.closed
+}
+
+// ReadAll reads pipe until its writer is done.
+func (h *fakeHost) ReadAll(pipe *fakePipe) []byte {
+	var all []byte
+	for {
+		p, done := h.Read(pipe)
+		all = append(all, p...)
+		if done {
+			return all
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// Respond resolves f with a response with status, header, and body.
+func (h *fakeHost) Respond(f *fakeFuture, status int, header http.Header, body string) {
+	h.RespondStreaming(f, status, header, &fakePipe{buf: []byte(body), closed: true})
+}
+
+// RespondStreaming resolves f with a response with a body read from pipe.
+func (h *fakeHost) RespondStreaming(f *fakeFuture, status int, header http.Header, pipe *fakePipe) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if header == nil {
+		header = http.Header{}
+	}
+	f.res = &fakeIncomingResponse{
+		status: status,
+		header: header,
+		body:   &fakeIncomingBody{pipe: pipe},
+	}
+	f.done = true
+}
+
+// Reject resolves f with error-code e.
+func (h *fakeHost) Reject(f *fakeFuture, e types.ErrorCode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f.err = &e
+	f.done = true
+}
+
+// WaitBody waits until the guest finishes or aborts body.
+func (h *fakeHost) WaitBody(body *fakeOutgoingBody) {
+	for {
+		h.mu.Lock()
+		done := body.finished || body.aborted
+		h.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+// Body returns the data written to body, which must be finished or aborted.
+func (h *fakeHost) Body(body *fakeOutgoingBody) []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return body.pipe.buf
+}
+
+// fakeResponse is the result of serving a request with [fakeServe].
+type fakeResponse struct {
+	ErrTag   int // error-code case sent instead of a response, or -1
+	Status   int
+	Header   http.Header
+	Body     string
+	Trailer  http.Header
+	Finished bool // response body finished, rather than aborted
+}
+
+// fakeServe serves req with s through the fake host, and returns the response.
+func fakeServe(h *fakeHost, s *Server, req *http.Request) *fakeResponse {
+	in, _ := h.Request(req)
+	out, o := h.Outparam()
+	s.handle(in, out)
+	return h.Response(o)
+}
+
+// Response returns the response set on o.
+func (h *fakeHost) Response(o *fakeOutparam) *fakeResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := &fakeResponse{ErrTag: o.errTag}
+	if o.response != nil {
+		r.Status = o.response.status
+		r.Header = o.response.header
+		b := o.response.body
+		r.Body = string(b.pipe.buf)
+		r.Trailer = b.trailers
+		r.Finished = b.finished
+	}
+	return r
+}
+
+// errorTag returns the error-code case of e.
+func errorTag(e *Error) int {
+	return int(e.code.Tag())
+}
+
+// Result types used by the host functions below.
+type (
+	readResult      = cm.Result[cm.List[uint8], cm.List[uint8], streams.StreamError]
+	budgetResult    = cm.Result[uint64, uint64, streams.StreamError]
+	writeResult     = cm.Result[streams.StreamError, struct{}, streams.StreamError]
+	headerResult    = cm.Result[types.HeaderError, struct{}, types.HeaderError]
+	incomingBodyRes = cm.Result[types.IncomingBody, types.IncomingBody, struct{}]
+	outgoingBodyRes = cm.Result[types.OutgoingBody, types.OutgoingBody, struct{}]
+	inputStreamRes  = cm.Result[streams.InputStream, streams.InputStream, struct{}]
+	outputStreamRes = cm.Result[streams.OutputStream, streams.OutputStream, struct{}]
+	finishResult    = cm.Result[types.ErrorCode, struct{}, types.ErrorCode]
+	handleResult    = cm.Result[types.ErrorCodeShape, types.FutureIncomingResponse, types.ErrorCode]
+	responseResult  = cm.Result[types.ErrorCodeShape, types.IncomingResponse, types.ErrorCode]
+	responseGet     = cm.Result[responseResult, responseResult, struct{}]
+	trailersResult  = cm.Result[types.ErrorCodeShape, cm.Option[types.Trailers], types.ErrorCode]
+	trailersGet     = cm.Result[trailersResult, trailersResult, struct{}]
+)
+
+// streamError returns a last-operation-failed stream error.
+// The caller must hold h.mu.
+func (h *fakeHost) streamError(msg string) streams.StreamError {
+	return streams.StreamErrorLastOperationFailed(ioerror.Error(h.add(&fakeIOError{msg})))
+}
+
+// budget returns the check-write budget of pipe. The caller must hold h.mu.
+func (h *fakeHost) budget(pipe *fakePipe) int {
+	n := h.writeBudget
+	if n == 0 {
+		n = 64 << 10
+	}
+	if pipe.limit > 0 {
+		n = min(n, pipe.limit-len(pipe.buf))
+	}
+	if pipe.size > 0 {
+		n = min(n, pipe.size-pipe.n)
+	}
+	return max(n, 0)
+}
+
+func lift(p *uint8, n uint32) string {
+	return unsafe.String(p, n)
+}
+
+func toStatus(code uint32) int {
+	return int(code)
+}
+
+// Host functions. Each function implements the import of the same name.
+
+//go:linkname pollableResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/io/poll.wasmimport_PollableResourceDrop
+func pollableResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("pollable.drop")
+	take[*fakePollable](host, self0)
+}
+
+//go:linkname pollableReady github.com/ydnar/wasi-http-go/internal/wasi/io/poll.wasmimport_PollableReady
+func pollableReady(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("pollable.ready")
+	return cm.BoolToU32(get[*fakePollable](host, self0).ready())
+}
+
+//go:linkname pollableBlock github.com/ydnar/wasi-http-go/internal/wasi/io/poll.wasmimport_PollableBlock
+func pollableBlock(self0 uint32) {
+	p := poll.Pollable(self0)
+	pollPoll(&p, 1, new(cm.List[uint32]))
+}
+
+//go:linkname pollPoll github.com/ydnar/wasi-http-go/internal/wasi/io/poll.wasmimport_Poll
+func pollPoll(in0 *poll.Pollable, in1 uint32, result *cm.List[uint32]) {
+	in := unsafe.Slice(in0, in1)
+	host.mu.Lock()
+	host.count("poll")
+	pollables := make([]*fakePollable, len(in))
+	for i, p := range in {
+		pollables[i] = get[*fakePollable](host, uint32(p))
+	}
+	onPoll := host.onPoll
+	host.mu.Unlock()
+	if onPoll != nil {
+		onPoll(pollables)
+	}
+	for {
+		var ready []uint32
+		host.mu.Lock()
+		for i, p := range pollables {
+			if p.ready() {
+				ready = append(ready, uint32(i))
+			}
+		}
+		host.mu.Unlock()
+		if len(ready) > 0 {
+			*result = cm.ToList(ready)
+			return
+		}
+		time.Sleep(50 * time.Microsecond)
+	}
+}
+
+var clockStart = time.Now()
+
+//go:linkname clockNow github.com/ydnar/wasi-http-go/internal/wasi/clocks/monotonic-clock.wasmimport_Now
+func clockNow() uint64 {
+	return uint64(time.Since(clockStart))
+}
+
+//go:linkname clockSubscribeInstant github.com/ydnar/wasi-http-go/internal/wasi/clocks/monotonic-clock.wasmimport_SubscribeInstant
+func clockSubscribeInstant(when0 uint64) uint32 {
+	return clockSubscribeDuration(uint64(max(0, int64(when0)-int64(clockNow()))))
+}
+
+//go:linkname clockSubscribeDuration github.com/ydnar/wasi-http-go/internal/wasi/clocks/monotonic-clock.wasmimport_SubscribeDuration
+func clockSubscribeDuration(when0 uint64) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("clock.subscribe")
+	d := time.Duration(monotonicclock.Duration(when0))
+	at := time.Now().Add(d)
+	return host.add(&fakePollable{
+		ready: func() bool { return !time.Now().Before(at) },
+		clock: max(d, 1),
+	})
+}
+
+//go:linkname ioErrorResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/io/error.wasmimport_ErrorResourceDrop
+func ioErrorResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeIOError](host, self0)
+}
+
+//go:linkname ioErrorToDebugString github.com/ydnar/wasi-http-go/internal/wasi/io/error.wasmimport_ErrorToDebugString
+func ioErrorToDebugString(self0 uint32, result *string) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = get[*fakeIOError](host, self0).msg
+}
+
+//go:linkname inputStreamResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_InputStreamResourceDrop
+func inputStreamResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("input-stream.drop")
+	take[*fakeInputStream](host, self0)
+}
+
+//go:linkname inputStreamRead github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_InputStreamRead
+func inputStreamRead(self0 uint32, len0 uint64, result *readResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("input-stream.read")
+	pipe := get[*fakeInputStream](host, self0).pipe
+	switch {
+	case len(pipe.buf) > 0:
+		n := min(int(len0), len(pipe.buf))
+		p := append([]byte(nil), pipe.buf[:n]...)
+		pipe.buf = pipe.buf[n:]
+		*result = cm.OK[readResult](cm.ToList(p))
+	case pipe.closed:
+		*result = cm.Err[readResult](streams.StreamErrorClosed())
+	default:
+		*result = cm.OK[readResult](cm.List[uint8]{})
+	}
+}
+
+//go:linkname inputStreamBlockingRead github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_InputStreamBlockingRead
+func inputStreamBlockingRead(self0 uint32, len0 uint64, result *readResult) {
+	p := poll.Pollable(inputStreamSubscribe(self0))
+	pollableBlock(uint32(p))
+	pollableResourceDrop(uint32(p))
+	inputStreamRead(self0, len0, result)
+}
+
+//go:linkname inputStreamSubscribe github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_InputStreamSubscribe
+func inputStreamSubscribe(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("input-stream.subscribe")
+	pipe := get[*fakeInputStream](host, self0).pipe
+	return host.add(&fakePollable{ready: func() bool {
+		return len(pipe.buf) > 0 || pipe.closed
+	}})
+}
+
+//go:linkname outputStreamResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamResourceDrop
+func outputStreamResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.drop")
+	take[*fakeOutputStream](host, self0)
+}
+
+// writeError returns the error for writing to pipe, if any.
+// The caller must hold host.mu.
+func writeError(pipe *fakePipe) (streams.StreamError, bool) {
+	switch {
+	case pipe.dropped:
+		return streams.StreamErrorClosed(), true
+	case pipe.fail:
+		return host.streamError("write failed"), true
+	}
+	return streams.StreamError{}, false
+}
+
+//go:linkname outputStreamCheckWrite github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamCheckWrite
+func outputStreamCheckWrite(self0 uint32, result *budgetResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.check-write")
+	pipe := get[*fakeOutputStream](host, self0).pipe
+	if err, ok := writeError(pipe); ok {
+		*result = cm.Err[budgetResult](err)
+		return
+	}
+	*result = cm.OK[budgetResult](uint64(host.budget(pipe)))
+}
+
+//go:linkname outputStreamWrite github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamWrite
+func outputStreamWrite(self0 uint32, contents0 *uint8, contents1 uint32, result *writeResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.write")
+	pipe := get[*fakeOutputStream](host, self0).pipe
+	if err, ok := writeError(pipe); ok {
+		*result = cm.Err[writeResult](err)
+		return
+	}
+	if int(contents1) > host.budget(pipe) {
+		panic("fake host: write exceeds check-write budget")
+	}
+	pipe.written(int(contents1))
+	if !pipe.discard {
+		pipe.buf = append(pipe.buf, unsafe.Slice(contents0, contents1)...)
+	}
+	*result = cm.OK[writeResult](struct{}{})
+}
+
+//go:linkname outputStreamFlush github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamFlush
+func outputStreamFlush(self0 uint32, result *writeResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.flush")
+	pipe := get[*fakeOutputStream](host, self0).pipe
+	if err, ok := writeError(pipe); ok {
+		*result = cm.Err[writeResult](err)
+		return
+	}
+	*result = cm.OK[writeResult](struct{}{})
+}
+
+//go:linkname outputStreamSplice github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamSplice
+func outputStreamSplice(self0 uint32, src0 uint32, len0 uint64, result *budgetResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.splice")
+	dst := get[*fakeOutputStream](host, self0).pipe
+	src := get[*fakeInputStream](host, src0).pipe
+	if err, ok := writeError(dst); ok {
+		*result = cm.Err[budgetResult](err)
+		return
+	}
+	if len(src.buf) == 0 && src.closed {
+		*result = cm.Err[budgetResult](streams.StreamErrorClosed())
+		return
+	}
+	n := min(int(len0), len(src.buf), host.budget(dst))
+	dst.written(n)
+	if !dst.discard {
+		dst.buf = append(dst.buf, src.buf[:n]...)
+	}
+	src.buf = src.buf[n:]
+	*result = cm.OK[budgetResult](uint64(n))
+}
+
+//go:linkname outputStreamSubscribe github.com/ydnar/wasi-http-go/internal/wasi/io/streams.wasmimport_OutputStreamSubscribe
+func outputStreamSubscribe(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("output-stream.subscribe")
+	pipe := get[*fakeOutputStream](host, self0).pipe
+	return host.add(&fakePollable{ready: func() bool {
+		return pipe.dropped || pipe.fail || host.budget(pipe) > 0
+	}})
+}
+
+//go:linkname fieldsResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FieldsResourceDrop
+func fieldsResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeFields](host, self0)
+}
+
+//go:linkname newFields github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_NewFields
+func newFields() uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.fieldsHandle(http.Header{})
+}
+
+//go:linkname fieldsEntries github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FieldsEntries
+func fieldsEntries(self0 uint32, result *cm.List[cm.Tuple[types.FieldKey, types.FieldValue]]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	var entries []cm.Tuple[types.FieldKey, types.FieldValue]
+	for k, vv := range get[*fakeFields](host, self0).header {
+		for _, v := range vv {
+			entries = append(entries, cm.Tuple[types.FieldKey, types.FieldValue]{
+				F0: types.FieldKey(k),
+				F1: types.FieldValue(cm.ToList([]byte(v))),
+			})
+		}
+	}
+	*result = cm.ToList(entries)
+}
+
+//go:linkname fieldsSet github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FieldsSet
+func fieldsSet(self0 uint32, name0 *uint8, name1 uint32, value0 *types.FieldValue, value1 uint32, result *headerResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	name := lift(name0, name1)
+	if host.forbidden[strings.ToLower(name)] {
+		*result = cm.Err[headerResult](types.HeaderErrorForbidden)
+		return
+	}
+	var vals []string
+	for _, v := range unsafe.Slice(value0, value1) {
+		s := string(v.Slice())
+		if strings.ContainsAny(s, "\r\n") {
+			*result = cm.Err[headerResult](types.HeaderErrorInvalidSyntax)
+			return
+		}
+		vals = append(vals, s)
+	}
+	get[*fakeFields](host, self0).header[http.CanonicalHeaderKey(name)] = vals
+	*result = cm.OK[headerResult](struct{}{})
+}
+
+//go:linkname incomingRequestResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestResourceDrop
+func incomingRequestResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeIncomingRequest](host, self0)
+}
+
+//go:linkname incomingRequestAuthority github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestAuthority
+func incomingRequestAuthority(self0 uint32, result *cm.Option[string]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = cm.Some(get[*fakeIncomingRequest](host, self0).authority)
+}
+
+//go:linkname incomingRequestConsume github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestConsume
+func incomingRequestConsume(self0 uint32, result *incomingBodyRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	r := get[*fakeIncomingRequest](host, self0)
+	if r.consumed {
+		*result = cm.Err[incomingBodyRes](struct{}{})
+		return
+	}
+	r.consumed = true
+	*result = cm.OK[incomingBodyRes](types.IncomingBody(host.add(r.body)))
+}
+
+//go:linkname incomingRequestHeaders github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestHeaders
+func incomingRequestHeaders(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.fieldsHandle(get[*fakeIncomingRequest](host, self0).header)
+}
+
+//go:linkname incomingRequestMethod github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestMethod
+func incomingRequestMethod(self0 uint32, result *types.Method) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = toMethod(get[*fakeIncomingRequest](host, self0).method)
+}
+
+//go:linkname incomingRequestPathWithQuery github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestPathWithQuery
+func incomingRequestPathWithQuery(self0 uint32, result *cm.Option[string]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = cm.Some(get[*fakeIncomingRequest](host, self0).path)
+}
+
+//go:linkname incomingRequestScheme github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingRequestScheme
+func incomingRequestScheme(self0 uint32, result *cm.Option[types.Scheme]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = cm.Some(toScheme(get[*fakeIncomingRequest](host, self0).scheme))
+}
+
+//go:linkname responseOutparamSet github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_ResponseOutparamSet
+func responseOutparamSet(param0 uint32, response0 uint32, response1 uint32, response2 uint32, response3 uint64, response4 uint32, response5 uint32, response6 uint32, response7 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	o := take[*fakeOutparam](host, param0)
+	if o.set {
+		panic("fake host: response-outparam set twice")
+	}
+	o.set = true
+	if response0 == 0 {
+		o.response = take[*fakeOutgoingResponse](host, response1)
+	} else {
+		o.errTag = int(response1)
+	}
+}
+
+//go:linkname newOutgoingResponse github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_NewOutgoingResponse
+func newOutgoingResponse(headers0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.add(&fakeOutgoingResponse{
+		status: http.StatusOK,
+		header: take[*fakeFields](host, headers0).header,
+		body:   &fakeOutgoingBody{pipe: &fakePipe{}},
+	})
+}
+
+//go:linkname outgoingResponseResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingResponseResourceDrop
+func outgoingResponseResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeOutgoingResponse](host, self0)
+}
+
+//go:linkname outgoingResponseBody github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingResponseBody
+func outgoingResponseBody(self0 uint32, result *outgoingBodyRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = cm.OK[outgoingBodyRes](types.OutgoingBody(host.add(get[*fakeOutgoingResponse](host, self0).body)))
+}
+
+//go:linkname outgoingResponseSetStatusCode github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingResponseSetStatusCode
+func outgoingResponseSetStatusCode(self0 uint32, statusCode0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	get[*fakeOutgoingResponse](host, self0).status = toStatus(statusCode0)
+	return 0
+}
+
+//go:linkname outgoingBodyResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingBodyResourceDrop
+func outgoingBodyResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	b := take[*fakeOutgoingBody](host, self0)
+	b.aborted = true
+	b.pipe.closed = true
+}
+
+//go:linkname outgoingBodyWrite github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingBodyWrite
+func outgoingBodyWrite(self0 uint32, result *outputStreamRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	b := get[*fakeOutgoingBody](host, self0)
+	if b.written {
+		*result = cm.Err[outputStreamRes](struct{}{})
+		return
+	}
+	b.written = true
+	*result = cm.OK[outputStreamRes](streams.OutputStream(host.add(&fakeOutputStream{b.pipe})))
+}
+
+//go:linkname outgoingBodyFinish github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingBodyFinish
+func outgoingBodyFinish(this0 uint32, trailers0 uint32, trailers1 uint32, result *finishResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	b := take[*fakeOutgoingBody](host, this0)
+	if trailers0 != 0 {
+		b.trailers = take[*fakeFields](host, trailers1).header
+	}
+	b.finished = true
+	b.pipe.closed = true
+	*result = cm.OK[finishResult](struct{}{})
+}
+
+//go:linkname incomingBodyResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingBodyResourceDrop
+func incomingBodyResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("incoming-body.drop")
+	b := take[*fakeIncomingBody](host, self0)
+	b.pipe.dropped = true
+}
+
+//go:linkname incomingBodyStream github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingBodyStream
+func incomingBodyStream(self0 uint32, result *inputStreamRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	b := get[*fakeIncomingBody](host, self0)
+	if b.streamed {
+		*result = cm.Err[inputStreamRes](struct{}{})
+		return
+	}
+	b.streamed = true
+	*result = cm.OK[inputStreamRes](streams.InputStream(host.add(&fakeInputStream{b.pipe})))
+}
+
+//go:linkname incomingBodyFinish github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingBodyFinish
+func incomingBodyFinish(this0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("incoming-body.finish")
+	b := take[*fakeIncomingBody](host, this0)
+	return host.add(&fakeFutureTrailers{b})
+}
+
+//go:linkname futureTrailersResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureTrailersResourceDrop
+func futureTrailersResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeFutureTrailers](host, self0)
+}
+
+//go:linkname futureTrailersSubscribe github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureTrailersSubscribe
+func futureTrailersSubscribe(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	pipe := get[*fakeFutureTrailers](host, self0).body.pipe
+	return host.add(&fakePollable{ready: func() bool { return pipe.closed }})
+}
+
+//go:linkname futureTrailersGet github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureTrailersGet
+func futureTrailersGet(self0 uint32, result *cm.Option[trailersGet]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	b := get[*fakeFutureTrailers](host, self0).body
+	if !b.pipe.closed {
+		*result = cm.None[trailersGet]()
+		return
+	}
+	trailers := cm.None[types.Trailers]()
+	if b.trailers != nil {
+		trailers = cm.Some(types.Trailers(host.fieldsHandle(b.trailers)))
+	}
+	*result = cm.Some(cm.OK[trailersGet](cm.OK[trailersResult](trailers)))
+}
+
+//go:linkname newOutgoingRequest github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_NewOutgoingRequest
+func newOutgoingRequest(headers0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.add(&fakeOutgoingRequest{
+		method: http.MethodGet,
+		header: take[*fakeFields](host, headers0).header,
+		body:   &fakeOutgoingBody{pipe: &fakePipe{}},
+	})
+}
+
+//go:linkname outgoingRequestResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestResourceDrop
+func outgoingRequestResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeOutgoingRequest](host, self0)
+}
+
+//go:linkname outgoingRequestBody github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestBody
+func outgoingRequestBody(self0 uint32, result *outgoingBodyRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	*result = cm.OK[outgoingBodyRes](types.OutgoingBody(host.add(get[*fakeOutgoingRequest](host, self0).body)))
+}
+
+var methods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+//go:linkname outgoingRequestSetMethod github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestSetMethod
+func outgoingRequestSetMethod(self0 uint32, method0 uint32, method1 *uint8, method2 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	r := get[*fakeOutgoingRequest](host, self0)
+	if int(method0) < len(methods) {
+		r.method = methods[method0]
+	} else {
+		r.method = lift(method1, method2)
+	}
+	return 0
+}
+
+//go:linkname outgoingRequestSetScheme github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestSetScheme
+func outgoingRequestSetScheme(self0 uint32, scheme0 uint32, scheme1 uint32, scheme2 *uint8, scheme3 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	r := get[*fakeOutgoingRequest](host, self0)
+	switch {
+	case scheme0 == 0:
+		r.scheme = ""
+	case scheme1 == 0:
+		r.scheme = "http"
+	case scheme1 == 1:
+		r.scheme = "https"
+	default:
+		r.scheme = lift(scheme2, scheme3)
+	}
+	return 0
+}
+
+//go:linkname outgoingRequestSetAuthority github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestSetAuthority
+func outgoingRequestSetAuthority(self0 uint32, authority0 uint32, authority1 *uint8, authority2 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	get[*fakeOutgoingRequest](host, self0).authority = lift(authority1, authority2)
+	return 0
+}
+
+//go:linkname outgoingRequestSetPathWithQuery github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_OutgoingRequestSetPathWithQuery
+func outgoingRequestSetPathWithQuery(self0 uint32, pathWithQuery0 uint32, pathWithQuery1 *uint8, pathWithQuery2 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	get[*fakeOutgoingRequest](host, self0).path = lift(pathWithQuery1, pathWithQuery2)
+	return 0
+}
+
+//go:linkname requestOptionsResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_RequestOptionsResourceDrop
+func requestOptionsResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeRequestOptions](host, self0)
+}
+
+//go:linkname newRequestOptions github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_NewRequestOptions
+func newRequestOptions() uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.add(&fakeRequestOptions{})
+}
+
+//go:linkname requestOptionsSetConnectTimeout github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_RequestOptionsSetConnectTimeout
+func requestOptionsSetConnectTimeout(self0 uint32, duration0 uint32, duration1 uint64) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.noOptions["connect"] {
+		return 1
+	}
+	get[*fakeRequestOptions](host, self0).connect = time.Duration(duration1)
+	return 0
+}
+
+//go:linkname requestOptionsSetFirstByteTimeout github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_RequestOptionsSetFirstByteTimeout
+func requestOptionsSetFirstByteTimeout(self0 uint32, duration0 uint32, duration1 uint64) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.noOptions["first-byte"] {
+		return 1
+	}
+	get[*fakeRequestOptions](host, self0).firstByte = time.Duration(duration1)
+	return 0
+}
+
+//go:linkname requestOptionsSetBetweenBytesTimeout github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_RequestOptionsSetBetweenBytesTimeout
+func requestOptionsSetBetweenBytesTimeout(self0 uint32, duration0 uint32, duration1 uint64) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	if host.noOptions["between-bytes"] {
+		return 1
+	}
+	get[*fakeRequestOptions](host, self0).betweenBytes = time.Duration(duration1)
+	return 0
+}
+
+//go:linkname outgoingHandlerHandle github.com/ydnar/wasi-http-go/internal/wasi/http/outgoing-handler.wasmimport_Handle
+func outgoingHandlerHandle(request0 uint32, options0 uint32, options1 uint32, result *handleResult) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.count("handle")
+	r := take[*fakeOutgoingRequest](host, request0)
+	if options0 != 0 {
+		r.options = take[*fakeRequestOptions](host, options1)
+	}
+	if host.handleErr != nil {
+		*result = cm.Err[handleResult](*host.handleErr)
+		return
+	}
+	f := &fakeFuture{}
+	if onRequest := host.onRequest; onRequest != nil {
+		go onRequest(r, f)
+	}
+	*result = cm.OK[handleResult](types.FutureIncomingResponse(host.add(f)))
+}
+
+//go:linkname futureIncomingResponseResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureIncomingResponseResourceDrop
+func futureIncomingResponseResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeFuture](host, self0).dropped = true
+}
+
+//go:linkname futureIncomingResponseSubscribe github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureIncomingResponseSubscribe
+func futureIncomingResponseSubscribe(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	f := get[*fakeFuture](host, self0)
+	return host.add(&fakePollable{ready: func() bool { return f.done }})
+}
+
+//go:linkname futureIncomingResponseGet github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_FutureIncomingResponseGet
+func futureIncomingResponseGet(self0 uint32, result *cm.Option[responseGet]) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	f := get[*fakeFuture](host, self0)
+	switch {
+	case !f.done:
+		*result = cm.None[responseGet]()
+	case f.taken:
+		*result = cm.Some(cm.Err[responseGet](struct{}{}))
+	case f.err != nil:
+		f.taken = true
+		*result = cm.Some(cm.OK[responseGet](cm.Err[responseResult](*f.err)))
+	default:
+		f.taken = true
+		res := types.IncomingResponse(host.add(f.res))
+		*result = cm.Some(cm.OK[responseGet](cm.OK[responseResult](res)))
+	}
+}
+
+//go:linkname incomingResponseResourceDrop github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingResponseResourceDrop
+func incomingResponseResourceDrop(self0 uint32) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	take[*fakeIncomingResponse](host, self0)
+}
+
+//go:linkname incomingResponseStatus github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingResponseStatus
+func incomingResponseStatus(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return uint32(get[*fakeIncomingResponse](host, self0).status)
+}
+
+//go:linkname incomingResponseHeaders github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingResponseHeaders
+func incomingResponseHeaders(self0 uint32) uint32 {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	return host.fieldsHandle(get[*fakeIncomingResponse](host, self0).header)
+}
+
+//go:linkname incomingResponseConsume github.com/ydnar/wasi-http-go/internal/wasi/http/types.wasmimport_IncomingResponseConsume
+func incomingResponseConsume(self0 uint32, result *incomingBodyRes) {
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	r := get[*fakeIncomingResponse](host, self0)
+	if r.consumed {
+		*result = cm.Err[incomingBodyRes](struct{}{})
+		return
+	}
+	r.consumed = true
+	*result = cm.OK[incomingBodyRes](types.IncomingBody(host.add(r.body)))
+}
@@ -0,0 +1,179 @@
+package wasihttp
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	monotonicclock "github.com/ydnar/wasi-http-go/internal/wasi/clocks/monotonic-clock"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/poll"
+	"go.bytecodealliance.org/cm"
+)
+
+// await blocks the calling goroutine until p is ready, deadline has passed,
+// or ctx is done. A zero deadline means no deadline.
+// It returns [os.ErrDeadlineExceeded] if deadline passes before p is ready,
+// or ctx.Err() if ctx is done first. The deadline of ctx, if any, is enforced
+// even if the calling goroutine is the only one running.
+// The caller retains ownership of p.
+func await(ctx context.Context, p poll.Pollable, deadline time.Time) error {
+	if p.Ready() {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timeout := os.ErrDeadlineExceeded
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+		timeout = context.DeadlineExceeded
+	}
+	if deadline.IsZero() {
+		_, err := wait(ctx, p)
+		return err
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return timeout
+	}
+	timer := monotonicclock.SubscribeDuration(monotonicclock.Duration(d))
+	defer timer.ResourceDrop()
+	i, err := wait(ctx, p, timer)
+	if err != nil {
+		return err
+	}
+	if i != 0 {
+		return timeout
+	}
+	return nil
+}
+
+// pastDeadline reports whether deadline is non-zero and has passed.
+// Reads and writes check it before calling the host, as await only
+// enforces a deadline if the operation would block.
+func pastDeadline(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// wait parks the calling goroutine until at least one of pollables is ready,
+// and returns the index of a ready pollable. Other goroutines continue to run
+// while the calling goroutine is parked. If ctx is done first, wait returns
+// ctx.Err(). The caller retains ownership of pollables.
+func wait(ctx context.Context, pollables ...poll.Pollable) (int, error) {
+	w := &waiter{
+		pollables: pollables,
+		ready:     make(chan int, 1),
+	}
+	defaultReactor.register(w)
+	select {
+	case i := <-w.ready:
+		return i, nil
+	case <-ctx.Done():
+		if defaultReactor.unregister(w) {
+			return -1, ctx.Err()
+		}
+		// A pollable became ready before w could be unregistered.
+		return <-w.ready, nil
+	}
+}
+
+var defaultReactor reactor
+
+// pollAll blocks until at least one pollable is ready.
+// It is a variable so tests can substitute a fake host.
+var pollAll = poll.Poll
+
+// reactor multiplexes pollables from multiple goroutines into a single call
+// to [poll.Poll], so a blocked goroutine does not block the entire instance.
+type reactor struct {
+	mu      sync.Mutex
+	waiters []*waiter
+	running bool
+}
+
+// waiter is a goroutine waiting for one or more pollables.
+type waiter struct {
+	pollables []poll.Pollable
+	ready     chan int // receives the index of a ready pollable
+}
+
+func (r *reactor) register(w *waiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.waiters = append(r.waiters, w)
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+}
+
+// unregister removes w from r, reporting whether it was still waiting.
+func (r *reactor) unregister(w *waiter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(w)
+}
+
+// pollInterval bounds each call to [poll.Poll] made by the reactor.
+// While poll.Poll blocks, the instance is blocked, so goroutines waiting on
+// runtime timers, such as [time.Sleep], cannot run until it returns.
+const pollInterval = 10 * time.Millisecond
+
+// run polls until there are no more waiters.
+func (r *reactor) run() {
+	var list []poll.Pollable
+	var owners []*waiter
+	var indexes []int
+	for {
+		// Yield to other goroutines before blocking the instance in poll.Poll,
+		// so they can run and register their own pollables.
+		runtime.Gosched()
+
+		r.mu.Lock()
+		if len(r.waiters) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		list, owners, indexes = list[:0], owners[:0], indexes[:0]
+		for _, w := range r.waiters {
+			for i, p := range w.pollables {
+				list = append(list, p)
+				owners = append(owners, w)
+				indexes = append(indexes, i)
+			}
+		}
+		r.mu.Unlock()
+
+		timer := monotonicclock.SubscribeDuration(monotonicclock.Duration(pollInterval))
+		list = append(list, timer)
+		ready := pollAll(cm.ToList(list))
+		timer.ResourceDrop()
+
+		r.mu.Lock()
+		for _, i := range ready.Slice() {
+			if int(i) >= len(owners) {
+				continue // timer
+			}
+			w := owners[i]
+			if r.remove(w) {
+				w.ready <- indexes[i]
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// remove removes w from r, reporting whether it was found.
+// The caller must hold r.mu.
+func (r *reactor) remove(w *waiter) bool {
+	for i, w2 := range r.waiters {
+		if w2 == w {
+			r.waiters = append(r.waiters[:i], r.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReactorPollInterval tests that the reactor returns from poll.Poll
+// at least every pollInterval, so goroutines waiting on runtime timers can
+// run while another goroutine waits for a pollable that is not ready.
+func TestReactorPollInterval(t *testing.T) {
+	h := newFakeHost(t)
+	var mu sync.Mutex
+	var polls [][]*fakePollable
+	h.onPoll = func(pollables []*fakePollable) {
+		mu.Lock()
+		defer mu.Unlock()
+		polls = append(polls, pollables)
+	}
+
+	pending := h.Pollable(func() bool { return false })
+	defer pending.ResourceDrop()
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		_, err := wait(ctx, pending)
+		waited <- err
+	}()
+
+	slept := make(chan struct{})
+	go func() {
+		time.Sleep(5 * pollInterval)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+	case err := <-waited:
+		t.Fatalf("wait returned early: %v", err)
+	}
+
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("wait: got %v, expected %v", err, context.Canceled)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		defaultReactor.mu.Lock()
+		running := defaultReactor.running
+		defaultReactor.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("reactor did not return from poll")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(polls) < 2 {
+		t.Fatalf("got %d calls to poll, expected at least 2", len(polls))
+	}
+	for i, pollables := range polls {
+		var timer bool
+		for _, p := range pollables {
+			if p.clock > 0 && p.clock <= pollInterval {
+				timer = true
+			}
+		}
+		if !timer {
+			t.Errorf("poll %d: no timer bounding the call to poll", i)
+		}
+	}
+}
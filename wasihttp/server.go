@@ -1,69 +1,308 @@
 package wasihttp
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	incominghandler "github.com/ydnar/wasi-http-go/internal/wasi/http/incoming-handler"
 	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
 	"go.bytecodealliance.org/cm"
 )
 
-var defaultHandler http.Handler
-
 // Serve sets the [http.Handler] that incoming [wasi-http] requests are routed to.
 // By default, requests are routed to [http.DefaultServeMux].
+// It is equivalent to calling Serve on a [Server] with h as its Handler.
 //
 // [wasi-http]: https://github.com/webassembly/wasi-http
 func Serve(h http.Handler) {
-	defaultHandler = h
+	(&Server{Handler: h}).Serve()
 }
 
-func init() {
+// Server handles incoming [wasi-http] requests. Only one Server handles
+// requests at a time: the most recent one installed with [Server.Serve].
+//
+// Request bodies are read from the host only when the handler reads them.
+// If the handler responds without reading the request body, or closes it
+// before EOF, the rest of the body is discarded by the host rather than read.
+// For a request with "Expect: 100-continue", any 100 Continue response is
+// sent by the host, not by this package. A host may send it when the request
+// arrives, or wait until the handler first reads the body. In the latter case,
+// a handler that rejects the request without reading the body, for example
+// with 413 Request Entity Too Large, does not cause the client to send it.
+// Whether the host then closes the connection or reads and discards the body
+// also depends on the host. Requests with any other Expect header are rejected
+// with 417 Expectation Failed, like net/http.
+//
+// Informational (1xx) responses other than 101 Switching Protocols are not
+// sent, as wasi-http cannot send them, and do not count as the final status.
+// In particular, 103 Early Hints responses are not sent: headers set before
+// WriteHeader(103), such as Link, remain in the header map, and are sent with
+// the final response.
+//
+// The response body written for a HEAD request is discarded. Unlike net/http,
+// no Content-Length is derived from it, as the host checks the length of the
+// body actually sent against any Content-Length. A Content-Length set by the
+// handler is sent as is.
+//
+// As with [http.Server], incoming requests have RequestURI set. A handler
+// that forwards a request, such as a proxy, must clear RequestURI before
+// sending it with an [http.Client], which rejects requests with RequestURI set.
+//
+// [wasi-http]: https://github.com/webassembly/wasi-http
+type Server struct {
+	// Handler handles incoming requests. If nil, [http.DefaultServeMux] is used.
+	Handler http.Handler
+
+	// ErrorLog specifies an optional logger for errors serving requests,
+	// such as handler panics and response header fields rejected by the host.
+	// If nil, errors are logged to stderr.
+	ErrorLog *log.Logger
+
+	// PanicHandler, if non-nil, is called when the handler panics while
+	// serving a request, with the recovered value and a stack trace.
+	// If nil, the panic and stack trace are logged to ErrorLog.
+	// Panics with [http.ErrAbortHandler] are not reported.
+	//
+	// In either case, the panic is recovered and the request fails with an
+	// internal-error, or, if the response has already started, the response
+	// body is aborted.
+	PanicHandler func(r *http.Request, v any, stack []byte)
+
+	// MaxRequestBodyBytes, if positive, limits the size of request bodies.
+	// Requests with a larger Content-Length are rejected before the handler
+	// is called. Otherwise, reading more than MaxRequestBodyBytes from the
+	// request body returns an [Error] matching [ErrHTTPRequestBodySize],
+	// which is sent to the host if the handler does not write a response.
+	MaxRequestBodyBytes int64
+
+	// MaxHeaderBytes, if positive, limits the size of request header fields,
+	// counted as the size of their keys and values plus 4 bytes per value.
+	// Requests with larger headers are rejected with an
+	// http-request-header-section-size error before the handler is called.
+	// If zero, only the limits imposed by the host apply.
+	MaxHeaderBytes int
+
+	// RequestTimeout, if non-zero, limits the lifetime of each request.
+	// The request [context.Context] is canceled when the timeout elapses.
+	// By default, there is no timeout.
+	RequestTimeout time.Duration
+
+	// RemoteAddrHeader, if set, is the name of a request header from which
+	// [http.Request.RemoteAddr] is derived, such as "X-Forwarded-For",
+	// "X-Real-IP", or "Forwarded". The header must be set by a trusted host
+	// or proxy, as it can otherwise be spoofed by clients. If empty,
+	// RemoteAddr is not set, as wasi-http does not expose the client address.
+	RemoteAddrHeader string
+
+	// WriteBufferSize specifies the size of the buffer used when writing
+	// response bodies. Response data is sent to the host when the buffer is
+	// full or the response is flushed. If zero, a default (currently 4KB)
+	// is used.
+	WriteBufferSize int
+
+	// DisableResponseDefaults, if true, sends responses exactly as written by
+	// the handler. By default, responses follow the same rules as [net/http]:
+	// a handler that returns without writing a response sends 200 OK with an
+	// empty body, a missing Content-Type is detected from the first 512 bytes
+	// of the body with [http.DetectContentType], and a Content-Length is set
+	// if the handler writes a small body and returns without flushing it.
+	// To do so, response headers are not sent until the handler writes more
+	// than 2KB of body data, flushes the response, or returns.
+	//
+	// If true, response headers are sent when WriteHeader is called, and a
+	// handler that returns without writing a response fails the request with
+	// an http-response-incomplete error.
+	DisableResponseDefaults bool
+
+	// BaseContext optionally specifies a function that returns the base
+	// context for incoming requests. If nil, [context.Background] is used.
+	BaseContext func() context.Context
+
+	// OnRequestStart, if non-nil, is called with each incoming request before
+	// it is handled.
+	OnRequestStart func(r *http.Request)
+
+	// OnRequestEnd, if non-nil, is called with each incoming request after it
+	// is handled, with the response status code. The status is 0 if no
+	// response was sent, for example if the request was rejected or the
+	// handler panicked before writing a response.
+	OnRequestEnd func(r *http.Request, status int)
+}
+
+// Serve installs s as the handler for incoming wasi-http requests, replacing
+// any previously installed Server. It does not block.
+func (s *Server) Serve() {
 	// Assign the "wasi:http/incoming-handler@0.2.1#handle" export.
-	incominghandler.Exports.Handle = handleIncomingRequest
+	incominghandler.Exports.Handle = s.handle
+}
+
+func init() {
+	new(Server).Serve()
 }
 
-func handleIncomingRequest(req types.IncomingRequest, out types.ResponseOutparam) {
-	h := defaultHandler
+func (s *Server) handle(req types.IncomingRequest, out types.ResponseOutparam) {
+	if Debug {
+		defer reportLeaks("request", LiveHandles())
+	}
+	track("incoming-request")
+	track("response-outparam")
+	defer func() {
+		req.ResourceDrop()
+		untrack("incoming-request")
+	}()
+
+	h := s.Handler
 	if h == nil {
 		h = http.DefaultServeMux
 	}
-	w, err := newResponseWriter(req, out)
+	ctx, cancel := s.requestContext()
+	defer cancel()
+	w, err := newResponseWriter(s, ctx, cancel, req, out)
+	defer w.release()
+	if s.OnRequestStart != nil {
+		s.OnRequestStart(w.req)
+	}
+	if s.OnRequestEnd != nil {
+		defer func() {
+			s.OnRequestEnd(w.req, w.status)
+		}()
+	}
 	if err != nil {
-		return // TODO: log error?
+		// The request was rejected with an http-protocol-error.
+		s.logf("%v: %s", err, w.req.URL)
+		return
+	}
+	if err := s.checkLimits(w.req); err != nil {
+		w.fatal(err.code)
+		return
+	}
+	if expect := w.req.Header.Get("Expect"); expect != "" && !strings.EqualFold(expect, "100-continue") {
+		w.WriteHeader(http.StatusExpectationFailed)
+		w.finish()
+		return
 	}
+	if s.MaxRequestBodyBytes > 0 && w.reqBody != nil {
+		w.reqBody.limit = s.MaxRequestBodyBytes
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			w.recoverPanic(v)
+		}
+	}()
 	h.ServeHTTP(w, w.req)
 	w.finish()
 }
 
-var _ http.ResponseWriter = &responseWriter{}
+// logf logs to stderr, which is wasi:cli/stderr in a wasi-http component.
+func logf(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+// logf logs to s.ErrorLog, if set, or stderr.
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	logf(format, args...)
+}
+
+// requestContext returns a [context.Context] for an incoming request.
+// The context is canceled when the request completes, the client goes away,
+// or s.RequestTimeout elapses.
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if s.BaseContext != nil {
+		ctx = s.BaseContext()
+		if ctx == nil {
+			panic("wasihttp: BaseContext returned a nil context")
+		}
+	}
+	if s.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, s.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// checkLimits returns an [Error] if r exceeds the header or body size limits of s.
+func (s *Server) checkLimits(r *http.Request) *Error {
+	if s.MaxHeaderBytes > 0 {
+		if n := headerSize(r.Header); n > s.MaxHeaderBytes {
+			return &Error{types.ErrorCodeHTTPRequestHeaderSectionSize(cm.Some(uint32(min(n, math.MaxUint32))))}
+		}
+	}
+	if s.MaxRequestBodyBytes > 0 && r.ContentLength > s.MaxRequestBodyBytes {
+		return &Error{types.ErrorCodeHTTPRequestBodySize(cm.Some(uint64(r.ContentLength)))}
+	}
+	return nil
+}
+
+// headerSize returns the approximate wire size of h, counting each
+// value as a "Key: value\r\n" line.
+func headerSize(h http.Header) int {
+	var n int
+	for k, vv := range h {
+		for _, v := range vv {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+var (
+	_ http.ResponseWriter = &responseWriter{}
+	_ http.Flusher        = &responseWriter{}
+	_ io.ReaderFrom       = &responseWriter{}
+)
 
 type responseWriter struct {
+	srv         *Server
 	out         types.ResponseOutparam
 	req         *http.Request
+	cancel      context.CancelFunc // cancels the request context
 	header      http.Header
+	trailers    []string // trailer keys declared in the Trailer header
 	wroteHeader bool
-	status      int // HTTP status code passed to WriteHeader
+	status      int         // HTTP status code passed to WriteHeader
+	snapshot    http.Header // header at the time WriteHeader was called
+	pre         []byte      // body data written before headers are sent
+	sentHeader  bool        // response headers sent to the host
 
 	res    types.OutgoingResponse // valid after headers are sent
 	body   types.OutgoingBody     // valid after res.Body() is called
 	writer *bodyWriter            // valid after body.Stream() is called
 
+	reqBody       *bodyReader // nil if the request could not be read
+	writeDeadline time.Time   // zero means no deadline
+
 	finished bool
 }
 
-func newResponseWriter(req types.IncomingRequest, out types.ResponseOutparam) (*responseWriter, error) {
-	r, err := incomingRequest(req)
+func newResponseWriter(s *Server, ctx context.Context, cancel context.CancelFunc, req types.IncomingRequest, out types.ResponseOutparam) (*responseWriter, error) {
+	r, err := incomingRequest(ctx, req, s.RemoteAddrHeader)
 	w := &responseWriter{
+		srv:    s,
 		out:    out,
 		req:    r,
+		cancel: cancel,
 		header: make(http.Header),
 	}
 	if err != nil {
 		w.fatal(types.ErrorCodeHTTPProtocolError())
+		return w, err
 	}
-	return w, err
+	w.reqBody, _ = r.Body.(*bodyReader)
+	return w, nil
 }
 
 func (w *responseWriter) Header() http.Header {
@@ -78,31 +317,297 @@ func (w *responseWriter) Write(p []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
+	if !bodyAllowedForStatus(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if !w.sentHeader {
+		if len(w.pre)+len(p) <= bufferBeforeChunkingSize {
+			w.pre = append(w.pre, p...)
+			return len(p), nil
+		}
+		if err := w.commit(p, false); err != nil {
+			return 0, err
+		}
+	}
+	if w.req.Method == http.MethodHead {
+		return len(p), nil // discard the body
+	}
 	return w.writer.Write(p)
 }
 
+// ReadFrom implements [io.ReaderFrom]. If src is a wasi-http body, such as
+// the body of an [http.Response] returned by [Transport], data is spliced
+// by the host without copying it into guest memory.
+func (w *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.finished {
+		return 0, errors.New("wasihttp: write after close")
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowedForStatus(w.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	if w.req.Method == http.MethodHead {
+		// Count the body for its Content-Length, but discard it.
+		return io.Copy(writerOnly{w}, src)
+	}
+	var n int64
+	if !w.sentHeader {
+		// Buffer the start of src, which may be used to detect its Content-Type.
+		var err error
+		n, err = io.CopyN(writerOnly{w}, src, sniffLen)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		if !w.sentHeader {
+			if err := w.commit(nil, false); err != nil {
+				return n, err
+			}
+		}
+	}
+	m, err := w.writer.ReadFrom(src)
+	return n + m, err
+}
+
+// WriteHeader implements [http.ResponseWriter]. Like net/http, it panics if
+// code is not a valid 3-digit HTTP status code. Informational (1xx) status
+// codes are handled as described in [Server].
 func (w *responseWriter) WriteHeader(code int) {
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", code))
+	}
 	if w.finished || w.wroteHeader {
 		// TODO: improve logging
 		return
 	}
-
-	// TODO: handle 1xx informational headers?
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		return
+	}
 
 	w.wroteHeader = true
 	w.status = code
 
-	headers := toFields(w.header)
+	w.declareTrailers()
+	if w.srv.DisableResponseDefaults {
+		w.sendHeader(w.header)
+		return
+	}
+	// Hold the headers until body data is written, so the Content-Type
+	// and Content-Length can be set. Later changes to w.header are ignored,
+	// except for trailers.
+	w.snapshot = w.header.Clone()
+}
+
+const (
+	// bufferBeforeChunkingSize is the amount of body data buffered before
+	// sending the response headers, matching net/http.
+	bufferBeforeChunkingSize = 2048
+
+	// sniffLen is the amount of body data used by [http.DetectContentType].
+	sniffLen = 512
+)
+
+// commit sends the headers held by WriteHeader, applying the same defaults as
+// [net/http], followed by any buffered body data. If the buffered data is
+// less than [sniffLen] bytes, p is used to detect the Content-Type.
+// If done is true, the handler has returned, and the buffered data is the
+// entire response body.
+func (w *responseWriter) commit(p []byte, done bool) error {
+	h := w.snapshot
+	data := w.pre
+	if len(data) < sniffLen && len(p) > 0 {
+		data = append(data[:len(data):len(data)], p[:min(len(p), sniffLen-len(data))]...)
+	}
+	hasTE := h.Get("Transfer-Encoding") != ""
+	if bodyAllowedForStatus(w.status) {
+		_, haveType := h["Content-Type"]
+		if !haveType && !hasTE && h.Get("Content-Encoding") == "" && len(data) > 0 {
+			h.Set("Content-Type", http.DetectContentType(data))
+		}
+		_, haveLength := h["Content-Length"]
+		if done && !haveLength && !hasTE && !w.hasTrailers() && w.req.Method != http.MethodHead {
+			h.Set("Content-Length", strconv.Itoa(len(w.pre)))
+		}
+	}
+	w.sendHeader(h)
+	pre := w.pre
+	w.pre = nil
+	if w.req.Method == http.MethodHead {
+		return nil // discard the body
+	}
+	_, err := w.writer.Write(pre)
+	return err
+}
+
+// bodyAllowedForStatus reports whether a response with status code may have a body.
+func bodyAllowedForStatus(code int) bool {
+	switch {
+	case code >= 100 && code <= 199:
+		return false
+	case code == http.StatusNoContent, code == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// suppressedHeaders returns the headers not sent in a response with status
+// code, which does not have a body, following the same rules as net/http.
+func suppressedHeaders(code int) []string {
+	switch {
+	case code == http.StatusNotModified:
+		return []string{"Content-Type", "Content-Length", "Transfer-Encoding"}
+	case !bodyAllowedForStatus(code):
+		return []string{"Content-Length", "Transfer-Encoding"}
+	}
+	return nil
+}
+
+// hasTrailers reports whether the response declares or sets any trailers.
+func (w *responseWriter) hasTrailers() bool {
+	if len(w.trailers) > 0 {
+		return true
+	}
+	for k := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendHeader sends the response status code and headers h to the host.
+func (w *responseWriter) sendHeader(h http.Header) {
+	w.sentHeader = true
+	headers, err := toFields(responseHeader(h, w.status))
+	if err != nil {
+		w.srv.logf("%v: %s", err, w.req.URL)
+	}
 	w.res = types.NewOutgoingResponse(headers)
-	w.res.SetStatusCode(types.StatusCode(code))
+	w.res.SetStatusCode(types.StatusCode(w.status))
 
 	w.body, _, _ = w.res.Body().Result() // the first call should always return OK
-	w.writer = newBodyWriter(w.body, func() http.Header {
-		return nil
-	})
+	w.writer = newBodyWriter(w.body, w.srv.WriteBufferSize, w.finalTrailers)
+	w.writer.closed = w.cancel // the client went away
+	w.writer.deadline = w.writeDeadline
 
 	// Consume the response-outparam and outgoing-response.
 	types.ResponseOutparamSet(w.out, cm.OK[outgoingResult](w.res))
+	untrack("response-outparam")
+}
+
+// Flush implements [http.Flusher]. It sends the response headers, if not
+// already sent, and flushes any buffered response body data to the host.
+func (w *responseWriter) Flush() {
+	w.FlushError()
+}
+
+// FlushError is like Flush, but returns an error if the flush failed.
+// It is used by [http.ResponseController].
+func (w *responseWriter) FlushError() error {
+	if w.finished {
+		return errors.New("wasihttp: flush after close")
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sentHeader {
+		if err := w.commit(nil, false); err != nil {
+			return err
+		}
+	}
+	return w.writer.flush()
+}
+
+// SetReadDeadline sets the deadline for reading the request body.
+// A zero value means no deadline. It is used by [http.ResponseController].
+func (w *responseWriter) SetReadDeadline(deadline time.Time) error {
+	if w.reqBody == nil {
+		return http.ErrNotSupported
+	}
+	w.reqBody.deadline = deadline
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writing the response body.
+// A zero value means no deadline. It is used by [http.ResponseController].
+func (w *responseWriter) SetWriteDeadline(deadline time.Time) error {
+	w.writeDeadline = deadline
+	if w.writer != nil {
+		w.writer.deadline = deadline
+	}
+	return nil
+}
+
+// EnableFullDuplex implements the [http.ResponseController] method of the same name.
+// Requests and responses in wasi-http are always full duplex: the request body
+// can be read after the response has started, so this always returns nil.
+func (w *responseWriter) EnableFullDuplex() error {
+	return nil
+}
+
+// declareTrailers records the trailer keys declared in the Trailer header,
+// following the same rules as [net/http].
+func (w *responseWriter) declareTrailers() {
+	for _, v := range w.header["Trailer"] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			switch k {
+			case "", "Transfer-Encoding", "Trailer", "Content-Length":
+				// Forbidden by RFC 9110, section 6.5.1.
+				continue
+			}
+			w.trailers = append(w.trailers, k)
+		}
+	}
+}
+
+// finalTrailers returns the response trailers, if any. Trailers are either
+// declared in the Trailer header before the response headers are written,
+// or set with keys prefixed with [http.TrailerPrefix].
+func (w *responseWriter) finalTrailers() http.Header {
+	var t http.Header
+	for k, vv := range w.header {
+		if kk, found := strings.CutPrefix(k, http.TrailerPrefix); found {
+			if t == nil {
+				t = make(http.Header)
+			}
+			t[http.CanonicalHeaderKey(kk)] = vv
+		}
+	}
+	for _, k := range w.trailers {
+		for _, v := range w.header[k] {
+			if t == nil {
+				t = make(http.Header)
+			}
+			t.Add(k, v)
+		}
+	}
+	return t
+}
+
+// responseHeader returns h without any keys prefixed with [http.TrailerPrefix],
+// or headers not allowed in a response with status code.
+// The returned header may share storage with h.
+func responseHeader(h http.Header, code int) http.Header {
+	var filtered http.Header
+	suppressed := suppressedHeaders(code)
+	for k := range h {
+		if !strings.HasPrefix(k, http.TrailerPrefix) && !slices.Contains(suppressed, k) {
+			continue
+		}
+		if filtered == nil {
+			filtered = h.Clone()
+		}
+		delete(filtered, k)
+	}
+	if filtered == nil {
+		return h
+	}
+	return filtered
 }
 
 func (w *responseWriter) finish() error {
@@ -110,15 +615,100 @@ func (w *responseWriter) finish() error {
 		return nil
 	}
 	if !w.wroteHeader {
-		// w.WriteHeader(http.StatusOK)
-		// If caller code did not set headers, status, or body, then respond with an error
-		// and let the server implementation handle the correct response.
-		w.fatal(types.ErrorCodeHTTPResponseIncomplete())
-		return nil
+		// If the request body exceeded the server limit, report that to the host.
+		// Otherwise, respond with 200 OK, like net/http, or, if response defaults
+		// are disabled, respond with an error and let the host determine the
+		// correct response.
+		var e *Error
+		if w.reqBody != nil && errors.As(w.reqBody.err, &e) && errors.Is(e, ErrHTTPRequestBodySize) {
+			w.fatal(e.code)
+			return nil
+		}
+		if w.srv.DisableResponseDefaults {
+			w.fatal(types.ErrorCodeHTTPResponseIncomplete())
+			return nil
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sentHeader {
+		if err := w.commit(nil, true); err != nil {
+			w.finished = true
+			w.writer.abort()
+			return err
+		}
 	}
 
 	w.finished = true
-	return w.writer.finish()
+	err := w.writer.finish()
+	var herr *HeaderError
+	if errors.As(err, &herr) {
+		w.srv.logf("%v: %s", err, w.req.URL)
+	}
+	return err
+}
+
+// recoverPanic reports a panic recovered from a handler and aborts the response.
+func (w *responseWriter) recoverPanic(v any) {
+	if v != http.ErrAbortHandler {
+		stack := debug.Stack()
+		if w.srv.PanicHandler != nil {
+			w.srv.PanicHandler(w.req, v, stack)
+		} else {
+			w.srv.logf("wasihttp: panic serving %s: %v\n%s", w.req.URL, v, stack)
+		}
+	}
+	w.abort(types.ErrorCodeInternalError(cm.Some(fmt.Sprint(v))))
+}
+
+// Abort ends the response to an incoming request with err, which is typically
+// one of the Err* values or an [Error] returned by [Transport]. If the response
+// headers have not been sent, err is sent to the host, which determines the
+// HTTP error response sent to the client. Otherwise, the response body is
+// dropped without being finished, which signals the host that the response
+// is incomplete. A nil err is treated as [ErrInternalError].
+//
+// Subsequent writes to w return an error. Abort unwraps w using an
+// Unwrap() http.ResponseWriter method, like [http.ResponseController].
+// It returns an error wrapping [http.ErrNotSupported] if w was not created
+// by this package.
+func Abort(w http.ResponseWriter, err *Error) error {
+	if err == nil {
+		err = ErrInternalError
+	}
+	for {
+		switch t := w.(type) {
+		case *responseWriter:
+			t.abort(err.code)
+			return nil
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return fmt.Errorf("wasihttp: Abort: %w", http.ErrNotSupported)
+		}
+	}
+}
+
+// abort ends the response with error code e. If the response headers have not
+// been sent, e is sent to the host. Otherwise, the outgoing body is dropped
+// without being finished, which signals the host that the response is incomplete.
+func (w *responseWriter) abort(e types.ErrorCode) {
+	if w.finished {
+		return
+	}
+	if !w.sentHeader {
+		w.fatal(e)
+		return
+	}
+	w.finished = true
+	w.writer.abort()
+}
+
+// release releases the request body, if not already closed by the handler.
+// Unread request body data is discarded.
+func (w *responseWriter) release() {
+	if w.reqBody != nil {
+		w.reqBody.abort(http.ErrBodyReadAfterClose)
+	}
 }
 
 // fatal sets an error code on the response, to allow the implementation
@@ -126,6 +716,7 @@ func (w *responseWriter) finish() error {
 func (w *responseWriter) fatal(e types.ErrorCode) {
 	w.finished = true
 	types.ResponseOutparamSet(w.out, cm.Err[outgoingResult](e))
+	untrack("response-outparam")
 }
 
 type outgoingResult = cm.Result[types.ErrorCodeShape, types.OutgoingResponse, types.ErrorCode]
@@ -0,0 +1,671 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+)
+
+func TestServerInvalidRequest(t *testing.T) {
+	h := newFakeHost(t)
+	var logs bytes.Buffer
+	var started, ended int
+	status := -1
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("handler called for invalid request")
+		}),
+		ErrorLog:       log.New(&logs, "", 0),
+		OnRequestStart: func(r *http.Request) { started++ },
+		OnRequestEnd: func(r *http.Request, code int) {
+			ended++
+			status = code
+		},
+	}
+	req := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+	req.Header["Content-Length"] = []string{"4", "5"}
+	res := fakeServe(h, s, req)
+
+	if res.ErrTag != errorTag(ErrHTTPProtocolError) {
+		t.Errorf("got error-code %d, expected %d", res.ErrTag, errorTag(ErrHTTPProtocolError))
+	}
+	if started != 1 || ended != 1 || status != 0 {
+		t.Errorf("got %d OnRequestStart, %d OnRequestEnd with status %d, expected 1, 1, and 0", started, ended, status)
+	}
+	if !strings.Contains(logs.String(), "conflicting Content-Length") {
+		t.Errorf("got log %q, expected the request error", logs.String())
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	h := newFakeHost(t)
+	var got struct {
+		remoteAddr string
+		deadline   bool
+		panicked   any
+		writes     int
+	}
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got.remoteAddr = r.RemoteAddr
+			_, got.deadline = r.Context().Deadline()
+			w.(http.Flusher).Flush()
+			before := h.Calls("output-stream.write")
+			for range 10 {
+				w.Write([]byte("xxxxx"))
+			}
+			got.writes = h.Calls("output-stream.write") - before
+			panic("boom")
+		}),
+		ErrorLog:         log.New(&bytes.Buffer{}, "", 0),
+		PanicHandler:     func(r *http.Request, v any, stack []byte) { got.panicked = v },
+		RequestTimeout:   time.Minute,
+		RemoteAddrHeader: "X-Real-IP",
+		WriteBufferSize:  10,
+	}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("X-Real-IP", "192.0.2.1")
+	res := fakeServe(h, s, req)
+
+	if got.remoteAddr != "192.0.2.1:0" {
+		t.Errorf("got RemoteAddr %q, expected %q", got.remoteAddr, "192.0.2.1:0")
+	}
+	if !got.deadline {
+		t.Error("request context has no deadline, expected RequestTimeout")
+	}
+	if got.panicked != "boom" {
+		t.Errorf("PanicHandler got %v, expected %q", got.panicked, "boom")
+	}
+	if res.Finished {
+		t.Error("response body finished after panic, expected aborted")
+	}
+	if got.writes != 5 {
+		t.Errorf("got %d stream writes, expected 5 with WriteBufferSize 10", got.writes)
+	}
+}
+
+// TestResponseConformance compares responses sent through the fake host with
+// those recorded by [httptest.ResponseRecorder] for the same handler.
+func TestResponseConformance(t *testing.T) {
+	large := strings.Repeat("a", 3000)
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+		// length is the Content-Length added by the response defaults.
+		length string
+		// sniffed reports whether the recorded Content-Type was detected,
+		// which is disabled by DisableResponseDefaults.
+		sniffed bool
+		// adjust, if non-nil, adjusts the recorded header where
+		// ResponseRecorder differs from net/http.
+		adjust func(h http.Header)
+		// incomplete reports whether the handler writes no response, which
+		// fails the request if DisableResponseDefaults is set.
+		incomplete bool
+	}{
+		{
+			name:       "no write",
+			handler:    func(w http.ResponseWriter, r *http.Request) {},
+			length:     "0",
+			incomplete: true,
+		},
+		{
+			name: "small write",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>hello</html>"))
+			},
+			length:  "18",
+			sniffed: true,
+		},
+		{
+			name: "large write",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(large))
+			},
+			sniffed: true,
+		},
+		{
+			name: "flush",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+				w.(http.Flusher).Flush()
+				w.Write([]byte(" world"))
+			},
+			sniffed: true,
+		},
+		{
+			name: "status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("{}"))
+			},
+			length:  "2",
+			sniffed: true,
+			adjust: func(h http.Header) {
+				// ResponseRecorder does not detect the type of a body
+				// written after WriteHeader is called; net/http does.
+				h.Set("Content-Type", "text/plain; charset=utf-8")
+			},
+		},
+		{
+			name: "content-type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte("{}"))
+			},
+			length: "2",
+		},
+		{
+			name: "content-encoding",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "identity")
+				w.Write([]byte("hello"))
+			},
+			length:  "5",
+			sniffed: true,
+			adjust: func(h http.Header) {
+				// net/http does not detect the type of an encoded body.
+				h.Del("Content-Type")
+			},
+		},
+		{
+			name: "transfer-encoding",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Transfer-Encoding", "chunked")
+				w.Write([]byte("hello"))
+			},
+			adjust: func(h http.Header) {
+				// Hop-by-hop headers are not sent to the host.
+				h.Del("Transfer-Encoding")
+			},
+		},
+		{
+			name: "content-length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				w.Write([]byte("hello"))
+			},
+			sniffed: true,
+		},
+		{
+			name: "trailers",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				w.Write([]byte("hello"))
+				w.Header().Set("X-Checksum", "abc")
+				w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+			},
+			sniffed: true,
+		},
+		{
+			name:   "head",
+			method: http.MethodHead,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			},
+			// Unlike net/http, no Content-Length is derived from the
+			// discarded body, which the host would check it against.
+			sniffed: true,
+		},
+		{
+			name:   "head no write",
+			method: http.MethodHead,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+			},
+			incomplete: true,
+		},
+		{
+			name: "204",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				w.WriteHeader(http.StatusNoContent)
+			},
+			sniffed: true,
+			adjust: func(h http.Header) {
+				// net/http removes headers describing a body that is not allowed,
+				// and does not detect its type.
+				h.Del("Content-Length")
+				h.Del("Content-Type")
+			},
+		},
+		{
+			name: "304",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("ETag", `"abc"`)
+				w.WriteHeader(http.StatusNotModified)
+			},
+			adjust: func(h http.Header) {
+				h.Del("Content-Type")
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, disable := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/DisableResponseDefaults=%t", tt.name, disable), func(t *testing.T) {
+				method := tt.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				rec := httptest.NewRecorder()
+				tt.handler(rec, httptest.NewRequest(method, "http://example.com/", nil))
+				want := rec.Result()
+				wantBody, _ := io.ReadAll(want.Body)
+				if method == http.MethodHead {
+					wantBody = nil
+				}
+				wantHeader := want.Header.Clone()
+				if tt.adjust != nil {
+					tt.adjust(wantHeader)
+				}
+				if tt.length != "" && !disable {
+					wantHeader.Set("Content-Length", tt.length)
+				}
+				if tt.sniffed && disable {
+					wantHeader.Del("Content-Type")
+				}
+
+				h := newFakeHost(t)
+				s := &Server{Handler: tt.handler, DisableResponseDefaults: disable}
+				got := fakeServe(h, s, httptest.NewRequest(method, "http://example.com/", nil))
+
+				if disable && tt.incomplete {
+					// The host determines the response.
+					if got.ErrTag != errorTag(ErrHTTPResponseIncomplete) {
+						t.Errorf("got error-code %d, expected %d", got.ErrTag, errorTag(ErrHTTPResponseIncomplete))
+					}
+					return
+				}
+				if got.ErrTag != -1 {
+					t.Fatalf("got error-code %d, expected a response", got.ErrTag)
+				}
+				if got.Status != want.StatusCode {
+					t.Errorf("got status %d, expected %d", got.Status, want.StatusCode)
+				}
+				if !reflect.DeepEqual(got.Header, wantHeader) {
+					t.Errorf("got header %v, expected %v", got.Header, wantHeader)
+				}
+				if got.Body != string(wantBody) {
+					t.Errorf("got body %q, expected %q", got.Body, wantBody)
+				}
+				if len(got.Trailer) > 0 || len(want.Trailer) > 0 {
+					if !reflect.DeepEqual(got.Trailer, want.Trailer) {
+						t.Errorf("got trailer %v, expected %v", got.Trailer, want.Trailer)
+					}
+				}
+				if !got.Finished {
+					t.Error("response body not finished")
+				}
+			})
+		}
+	}
+}
+
+// TestServerRequestContext tests when the request context is canceled.
+func TestServerRequestContext(t *testing.T) {
+	t.Run("handler returns", func(t *testing.T) {
+		h := newFakeHost(t)
+		var ctx context.Context
+		s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx = r.Context()
+		})}
+		fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+		if ctx.Err() != context.Canceled {
+			t.Errorf("got %v, expected %v", ctx.Err(), context.Canceled)
+		}
+	})
+
+	t.Run("RequestTimeout", func(t *testing.T) {
+		h := newFakeHost(t)
+		var err error
+		s := &Server{
+			RequestTimeout: 10 * time.Millisecond,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+					err = r.Context().Err()
+				case <-time.After(time.Second):
+				}
+			}),
+		}
+		fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+		if err != context.DeadlineExceeded {
+			t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	// The response stream is closed by the host after the response is
+	// flushed, as wasmtime does once Content-Length bytes are written.
+	// No data was refused, so the request context is not canceled.
+	t.Run("closed after flush", func(t *testing.T) {
+		h := newFakeHost(t)
+		var err error
+		var o *fakeOutparam
+		s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			h.Drop(o.response.body.pipe)
+			w.(http.Flusher).Flush()
+			err = r.Context().Err()
+		})}
+		in, _ := h.Request(httptest.NewRequest("GET", "http://example.com/", nil))
+		var out types.ResponseOutparam
+		out, o = h.Outparam()
+		s.handle(in, out)
+		if err != nil {
+			t.Errorf("got %v, expected nil", err)
+		}
+	})
+
+	// The response stream is closed by the host before all data is written,
+	// as when the client goes away.
+	t.Run("closed", func(t *testing.T) {
+		h := newFakeHost(t)
+		var err error
+		var o *fakeOutparam
+		s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			h.Drop(o.response.body.pipe)
+			w.Write([]byte(strings.Repeat("x", 2*defaultBufferSize)))
+			err = r.Context().Err()
+		})}
+		in, _ := h.Request(httptest.NewRequest("GET", "http://example.com/", nil))
+		var out types.ResponseOutparam
+		out, o = h.Outparam()
+		s.handle(in, out)
+		if err != context.Canceled {
+			t.Errorf("got %v, expected %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestServerTrailers(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DisableResponseDefaults=%t", disable), func(t *testing.T) {
+			h := newFakeHost(t)
+			s := &Server{
+				DisableResponseDefaults: disable,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Trailer", "X-Checksum, Content-Length")
+					w.Header().Set("X-Checksum", "early")
+					w.WriteHeader(http.StatusOK)
+					w.Write([]byte("hello"))
+					w.Header().Set("X-Checksum", "abc")
+					w.Header().Set("Content-Length", "5")
+					w.Header().Set(http.TrailerPrefix+"x-late", "def")
+				}),
+			}
+			res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+			if res.Header.Get("X-Checksum") != "early" {
+				t.Errorf("got X-Checksum header %q, expected %q", res.Header.Get("X-Checksum"), "early")
+			}
+			if _, ok := res.Header["Content-Length"]; ok {
+				t.Errorf("got Content-Length header %q, expected none with trailers", res.Header["Content-Length"])
+			}
+			want := http.Header{"X-Checksum": {"abc"}, "X-Late": {"def"}}
+			if !reflect.DeepEqual(res.Trailer, want) {
+				t.Errorf("got trailer %v, expected %v", res.Trailer, want)
+			}
+			if res.Body != "hello" || !res.Finished {
+				t.Errorf("got body %q, finished %t, expected %q, true", res.Body, res.Finished, "hello")
+			}
+		})
+	}
+}
+
+// TestServerProxy tests a handler that forwards requests with an
+// [http.Client] using [Transport], as in examples/proxy.
+func TestServerProxy(t *testing.T) {
+	h := newFakeHost(t)
+	type upstream struct {
+		method, scheme, authority, path string
+		header                          http.Header
+		body                            string
+	}
+	got := make(chan upstream, 1)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		body := h.ReadAll(r.body.pipe)
+		got <- upstream{r.method, r.scheme, r.authority, r.path, r.header, string(body)}
+		h.Respond(f, http.StatusCreated, http.Header{"X-Upstream": {"yes"}}, "echo: "+string(body))
+	}
+	client := &http.Client{Transport: new(Transport)}
+	s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.RequestURI != "/post?q=1" {
+			t.Errorf("got RequestURI %q, expected %q", r.RequestURI, "/post?q=1")
+		}
+		r2 := r.Clone(r.Context())
+		r2.Host = "upstream.example"
+		r2.URL.Host = "upstream.example"
+		r2.URL.Scheme = "https"
+		r2.RequestURI = ""
+		res, err := client.Do(r2)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer res.Body.Close()
+		maps.Copy(w.Header(), res.Header)
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	})}
+	req := httptest.NewRequest("POST", "http://example.com/post?q=1", strings.NewReader("hello"))
+	req.Header.Set("X-Client", "test")
+	res := fakeServe(h, s, req)
+
+	u := <-got
+	if u.method != "POST" || u.scheme != "https" || u.authority != "upstream.example" || u.path != "/post?q=1" {
+		t.Errorf("got upstream request %s %s://%s%s", u.method, u.scheme, u.authority, u.path)
+	}
+	if u.header.Get("X-Client") != "test" || u.body != "hello" {
+		t.Errorf("got upstream header %v and body %q", u.header, u.body)
+	}
+	if res.Status != http.StatusCreated || res.Header.Get("X-Upstream") != "yes" || res.Body != "echo: hello" {
+		t.Errorf("got response %d %v %q", res.Status, res.Header, res.Body)
+	}
+}
+
+// TestServerHopHeaders tests that hop-by-hop response header fields are not
+// sent to the host, which forbids them.
+func TestServerHopHeaders(t *testing.T) {
+	h := newFakeHost(t)
+	h.forbidden = map[string]bool{"connection": true, "keep-alive": true, "x-hop": true}
+	var buf bytes.Buffer
+	s := &Server{
+		ErrorLog: log.New(&buf, "", 0),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("X-Hop", "1")
+			w.Header().Set("X-End-To-End", "1")
+			w.Write([]byte("ok"))
+		}),
+	}
+	res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+	if res.Status != http.StatusOK || res.Body != "ok" {
+		t.Errorf("got response %d %q, expected %d %q", res.Status, res.Body, http.StatusOK, "ok")
+	}
+	for _, k := range []string{"Connection", "Keep-Alive", "X-Hop"} {
+		if v, ok := res.Header[k]; ok {
+			t.Errorf("got %s: %q, expected it to be removed", k, v)
+		}
+	}
+	if res.Header.Get("X-End-To-End") != "1" {
+		t.Errorf("got header %v, expected X-End-To-End", res.Header)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("got log %q, expected none", buf.String())
+	}
+}
+
+func TestAbort(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter) error
+		errTag  int    // error-code sent instead of a response, or -1
+		body    string // response body sent before the abort
+	}{
+		{
+			name: "before headers",
+			handler: func(w http.ResponseWriter) error {
+				w.Header().Set("X-Test", "1")
+				w.Write([]byte("buffered"))
+				return Abort(w, ErrDestinationNotFound)
+			},
+			errTag: errorTag(ErrDestinationNotFound),
+		},
+		{
+			name: "nil",
+			handler: func(w http.ResponseWriter) error {
+				return Abort(w, nil)
+			},
+			errTag: errorTag(ErrInternalError),
+		},
+		{
+			name: "after headers",
+			handler: func(w http.ResponseWriter) error {
+				w.Write([]byte("partial"))
+				w.(http.Flusher).Flush()
+				return Abort(w, ErrHTTPProtocolError)
+			},
+			errTag: -1,
+			body:   "partial",
+		},
+		{
+			name: "Unwrap",
+			handler: func(w http.ResponseWriter) error {
+				return Abort(unwrapWriter{w}, ErrConnectionRefused)
+			},
+			errTag: errorTag(ErrConnectionRefused),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			var abortErr, writeErr error
+			s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				abortErr = tt.handler(w)
+				_, writeErr = w.Write([]byte("more"))
+			})}
+			res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+			if abortErr != nil {
+				t.Fatalf("Abort: got %v, expected nil", abortErr)
+			}
+			if writeErr == nil {
+				t.Error("Write after Abort succeeded")
+			}
+			if res.ErrTag != tt.errTag {
+				t.Errorf("got error-code %d, expected %d", res.ErrTag, tt.errTag)
+			}
+			if tt.errTag >= 0 {
+				return
+			}
+			if res.Body != tt.body || res.Finished {
+				t.Errorf("got body %q, finished=%t, expected %q, not finished", res.Body, res.Finished, tt.body)
+			}
+		})
+	}
+
+	t.Run("not supported", func(t *testing.T) {
+		if err := Abort(httptest.NewRecorder(), ErrInternalError); !errors.Is(err, http.ErrNotSupported) {
+			t.Errorf("got %v, expected %v", err, http.ErrNotSupported)
+		}
+	})
+}
+
+// unwrapWriter wraps an [http.ResponseWriter], as middleware does.
+type unwrapWriter struct {
+	http.ResponseWriter
+}
+
+func (w unwrapWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// TestServerInformational tests that 1xx responses are not sent, and do not
+// count as the final status.
+func TestServerInformational(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DisableResponseDefaults=%t", disable), func(t *testing.T) {
+			h := newFakeHost(t)
+			s := &Server{
+				DisableResponseDefaults: disable,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusContinue)
+					w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+					w.WriteHeader(http.StatusEarlyHints)
+					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(http.StatusAccepted)
+					w.Write([]byte("ok"))
+				}),
+			}
+			res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+			if res.Status != http.StatusAccepted || res.Body != "ok" {
+				t.Errorf("got response %d %q, expected %d %q", res.Status, res.Body, http.StatusAccepted, "ok")
+			}
+			if got := res.Header.Get("Link"); got != "</style.css>; rel=preload; as=style" {
+				t.Errorf("got Link %q, expected it with the final response", got)
+			}
+		})
+	}
+}
+
+func TestServerBodyNotAllowed(t *testing.T) {
+	for _, code := range []int{http.StatusNoContent, http.StatusNotModified} {
+		t.Run(strconv.Itoa(code), func(t *testing.T) {
+			h := newFakeHost(t)
+			var writeErr, readFromErr error
+			s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+				_, writeErr = w.Write([]byte("body"))
+				_, readFromErr = w.(io.ReaderFrom).ReadFrom(strings.NewReader("body"))
+			})}
+			res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+			if writeErr != http.ErrBodyNotAllowed {
+				t.Errorf("Write: got %v, expected %v", writeErr, http.ErrBodyNotAllowed)
+			}
+			if readFromErr != http.ErrBodyNotAllowed {
+				t.Errorf("ReadFrom: got %v, expected %v", readFromErr, http.ErrBodyNotAllowed)
+			}
+			if res.Status != code || res.Body != "" || !res.Finished {
+				t.Errorf("got response %d %q, finished=%t, expected %d with no body", res.Status, res.Body, res.Finished, code)
+			}
+		})
+	}
+
+	// The body of a HEAD response is allowed, but discarded.
+	t.Run("HEAD", func(t *testing.T) {
+		h := newFakeHost(t)
+		var writeErr error
+		var n int64
+		s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, writeErr = w.Write([]byte("body"))
+			n, _ = w.(io.ReaderFrom).ReadFrom(strings.NewReader(strings.Repeat("x", 4*bufferBeforeChunkingSize)))
+		})}
+		res := fakeServe(h, s, httptest.NewRequest("HEAD", "http://example.com/", nil))
+		if writeErr != nil || n != 4*bufferBeforeChunkingSize {
+			t.Errorf("got Write error %v and ReadFrom %d bytes, expected no error and %d bytes", writeErr, n, 4*bufferBeforeChunkingSize)
+		}
+		if res.Status != http.StatusOK || res.Body != "" || res.Header.Get("Content-Length") != "" {
+			t.Errorf("got response %d %v %q, expected 200 with no body or Content-Length", res.Status, res.Header, res.Body)
+		}
+	})
+}
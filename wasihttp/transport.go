@@ -1,10 +1,19 @@
 package wasihttp
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	outgoinghandler "github.com/ydnar/wasi-http-go/internal/wasi/http/outgoing-handler"
 	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
@@ -19,71 +28,424 @@ func init() {
 	}
 }
 
+// outgoingHandle sends an outgoing request to the host.
+// It is a variable so tests can substitute a fake host.
+var outgoingHandle = outgoinghandler.Handle
+
 // Transport implements [http.RoundTripper] using [wasi-http] APIs.
 //
+// A Transport is safe for concurrent use by multiple goroutines.
+// Requests made from separate goroutines are in flight concurrently:
+// waiting for a response blocks only the calling goroutine, and the
+// responses to all outstanding requests are waited on together.
+//
 // [wasi-http]: https://github.com/webassembly/wasi-http
-type Transport struct{}
+type Transport struct {
+	// ConnectTimeout, if non-zero, specifies the maximum amount of time to
+	// wait for a connection to the server to be established.
+	ConnectTimeout time.Duration
+
+	// FirstByteTimeout, if non-zero, specifies the maximum amount of time to
+	// wait for the first byte of the response.
+	FirstByteTimeout time.Duration
+
+	// BetweenBytesTimeout, if non-zero, specifies the maximum amount of time
+	// to wait between receiving chunks of the response body.
+	BetweenBytesTimeout time.Duration
+
+	// DisableCompression, if true, prevents the Transport from requesting
+	// compression with an "Accept-Encoding: gzip" request header when the
+	// request contains no existing Accept-Encoding value. If the Transport
+	// requests gzip on its own and gets a gzipped response, it's transparently
+	// decoded in the Response.Body. However, if the user explicitly requested
+	// gzip it is not automatically uncompressed.
+	DisableCompression bool
+
+	// WriteBufferSize specifies the size of the buffer used when writing
+	// request bodies. If zero, a default (currently 4KB) is used.
+	WriteBufferSize int
+}
 
 // RoundTrip executes a single HTTP transaction.
+//
+// Timeouts are passed to the host as wasi-http request-options. If the request
+// context has a deadline, it limits the connect and first-byte timeouts. If the
+// host does not support a timeout, it is enforced by the guest instead.
+// Errors caused by a timeout report Timeout() == true.
+//
+// Hop-by-hop header fields, such as Connection and Keep-Alive, are not sent.
+// If the host rejects any other request header fields, RoundTrip returns a
+// [*HeaderError] listing them.
+//
+// The request body is written in a separate goroutine while waiting for the
+// response, so RoundTrip may return before the request body is fully written.
+// Errors writing the request body are returned when reading the response body.
+//
+// As with [http.Transport], the caller must close the response body.
+// Host resources for the response are held until it is closed or read to EOF.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Only close the body if it's not nil
-	if req.Body != nil {
-		defer req.Body.Close()
+	contentLength, err := outgoingLength(req)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	if err := req.Context().Err(); err != nil {
+		closeBody(req)
+		return nil, err
 	}
 
-	// TODO: wrap this into a helper func outgoingRequest?
-	r := types.NewOutgoingRequest(toFields(req.Header))
-	r.SetAuthority(cm.Some(requestAuthority(req))) // TODO: when should this be cm.None?
-	r.SetMethod(toMethod(req.Method))
-	r.SetPathWithQuery(requestPath(req))
-	r.SetScheme(cm.Some(toScheme(req.URL.Scheme))) // TODO: when should this be cm.None?
-
+	requestedGzip := t.requestGzip(req)
+	r, err := outgoingRequest(req, contentLength, requestedGzip)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	// The body must be taken before the request is passed to the host.
+	// Trailers are read after the body is copied, as req.Body may set their values.
 	body, _, _ := r.Body().Result() // the first call should always return OK
+	w := newBodyWriter(body, t.WriteBufferSize, func() http.Header {
+		return req.Trailer
+	})
 
-	// TODO: when are [options] used?
-	// [options]: https://github.com/WebAssembly/wasi-http/blob/main/wit/handler.wit#L38-L39
-	incoming, err, isErr := outgoinghandler.Handle(r, cm.None[types.RequestOptions]()).Result()
+	start := time.Now()
+	options, unsupported := requestOptions(t.timeouts(req.Context()))
+	incoming, errCode, isErr := outgoingHandle(r, options).Result()
 	if isErr {
 		// outgoing request is invalid or not allowed to be made
-		return nil, errors.New(err.String())
+		w.abort()
+		closeBody(req)
+		return nil, &Error{errCode}
 	}
-	defer incoming.ResourceDrop()
+	track("future-incoming-response")
+	defer func() {
+		incoming.ResourceDrop()
+		untrack("future-incoming-response")
+	}()
 
-	// Write request body
-	w := newBodyWriter(body, func() http.Header {
-		// TODO: extract request trailers
-		return nil
-	})
-
-	// Only copy from req.Body if it's not nil
-	if req.Body != nil {
-		if _, err := io.Copy(w, req.Body); err != nil {
-			return nil, fmt.Errorf("wasihttp: %v", err)
+	// Write request body.
+	ctx, cancel := context.WithCancel(req.Context())
+	w.ctx = ctx
+	uploaded := make(chan error, 1)
+	go func() {
+		err := writeRequestBody(w, req, contentLength)
+		// Report err before aborting w, so it is available to the reader
+		// of the response when the host sees the incomplete body.
+		uploaded <- err
+		if err != nil {
+			w.abort()
 		}
+	}()
+	// abortUpload stops writing the request body if RoundTrip fails.
+	// Closing req.Body unblocks a pending Read by the upload goroutine.
+	abortUpload := func() {
+		cancel()
+		closeBody(req)
 	}
-	w.finish()
 
-	// Wait for response
-	poll := incoming.Subscribe()
-	if !poll.Ready() {
-		poll.Block()
+	// Wait for response, enforcing any timeouts the host does not support.
+	// If the request context is done, the response future is dropped,
+	// which cancels the request.
+	var deadline time.Time
+	if unsupported.connect > 0 || unsupported.firstByte > 0 {
+		deadline = start.Add(unsupported.connect + unsupported.firstByte)
 	}
+	poll := incoming.Subscribe()
+	err = await(req.Context(), poll, deadline)
 	poll.ResourceDrop()
+	if err != nil {
+		abortUpload()
+		if err == os.ErrDeadlineExceeded {
+			return nil, &Error{types.ErrorCodeHTTPResponseTimeout()}
+		}
+		return nil, err
+	}
 
 	future := incoming.Get()
 	if future.None() {
+		abortUpload()
 		return nil, fmt.Errorf("wasihttp: future response is None after blocking")
 	}
 	// TODO: figure out a better way to handle option<result<result<incoming-response, error-code>>>
-	response, err, isErr := future.Some().OK().Result() // the first call should always return OK
+	response, errCode, isErr := future.Some().OK().Result() // the first call should always return OK
 	if isErr {
-		// TODO: what do we do with the HTTP proxy error-code?
-		return nil, errors.New(err.String())
+		err := uploadError(uploaded)
+		abortUpload()
+		if err != nil {
+			return nil, err
+		}
+		return nil, &Error{errCode}
+	}
+	track("incoming-response")
+	dropResponse := func() {
+		response.ResourceDrop() // after its body is finished
+		untrack("incoming-response")
+	}
+
+	res, err := incomingResponse(req, response)
+	if err != nil {
+		abortUpload()
+		dropResponse()
+		return nil, err
+	}
+	rb := res.Body.(*bodyReader)
+	rb.ctx = req.Context()
+	rb.timeout = unsupported.betweenBytes
+	rb.done = func() error {
+		// Check for an upload error before canceling the upload, which
+		// would otherwise report only context.Canceled.
+		err := uploadError(uploaded)
+		// The response is complete, so stop writing the request body.
+		cancel()
+		dropResponse()
+		return err
+	}
+	// As with net/http, a response without a body has Body http.NoBody,
+	// and is released now.
+	if req.Method == http.MethodHead || res.ContentLength == 0 {
+		res.Body = http.NoBody
+		if err := rb.finish(); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	// Release the response if its body is garbage collected without being
+	// closed. TinyGo does not run finalizers, so callers must still close it.
+	runtime.SetFinalizer(rb, (*bodyReader).Close)
+	if requestedGzip && strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+		res.Body = &gzipReader{body: res.Body}
+	}
+	return res, nil
+}
+
+// requestGzip reports whether the Transport should request a gzip-compressed
+// response for req, following the same rules as [http.Transport].
+func (t *Transport) requestGzip(req *http.Request) bool {
+	return !t.DisableCompression &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" &&
+		req.Method != http.MethodHead
+}
+
+// gzipReader lazily decompresses a gzip-encoded response body.
+type gzipReader struct {
+	body io.ReadCloser
+	zr   *gzip.Reader // nil until first Read
+	err  error        // sticky error
+}
+
+func (gz *gzipReader) Read(p []byte) (int, error) {
+	if gz.err != nil {
+		return 0, gz.err
+	}
+	if gz.zr == nil {
+		gz.zr, gz.err = gzip.NewReader(gz.body)
+		if gz.err != nil {
+			if gz.err != io.EOF { // empty body
+				gz.err = contentCodingError(gz.err)
+			}
+			return 0, gz.err
+		}
+	}
+	n, err := gz.zr.Read(p)
+	if err != nil && err != io.EOF {
+		err = contentCodingError(err)
+	}
+	gz.err = err
+	return n, err
+}
+
+func (gz *gzipReader) Close() error {
+	return gz.body.Close()
+}
+
+// contentCodingError returns an error matching [ErrHTTPResponseContentCoding]
+// for an error decoding a gzip-encoded response body. Errors from reading the
+// underlying body are returned unchanged.
+func contentCodingError(err error) error {
+	if !errors.Is(err, gzip.ErrHeader) && !errors.Is(err, gzip.ErrChecksum) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		var ce flate.CorruptInputError
+		if !errors.As(err, &ce) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %w", &Error{types.ErrorCodeHTTPResponseContentCoding(cm.Some("gzip"))}, err)
+}
+
+// timeouts are the timeouts for a single request.
+// Zero means no timeout.
+type timeouts struct {
+	connect      time.Duration
+	firstByte    time.Duration
+	betweenBytes time.Duration
+}
+
+// timeouts returns the timeouts for a request with ctx.
+// The deadline of ctx, if any, limits the connect and first-byte timeouts.
+func (t *Transport) timeouts(ctx context.Context) timeouts {
+	to := timeouts{
+		connect:      t.ConnectTimeout,
+		firstByte:    t.FirstByteTimeout,
+		betweenBytes: t.BetweenBytesTimeout,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		d := max(time.Until(deadline), 1) // zero means no timeout
+		to.connect = minTimeout(to.connect, d)
+		to.firstByte = minTimeout(to.firstByte, d)
+	}
+	return to
+}
+
+func minTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || b < a {
+		return b
+	}
+	return a
+}
+
+// requestOptions returns wasi-http request-options for to, and the timeouts
+// not supported by the host, which must be enforced by the guest.
+func requestOptions(to timeouts) (cm.Option[types.RequestOptions], timeouts) {
+	var unsupported timeouts
+	if to == (timeouts{}) {
+		return cm.None[types.RequestOptions](), unsupported
+	}
+	options := types.NewRequestOptions()
+	if to.connect > 0 && options.SetConnectTimeout(cm.Some(types.Duration(to.connect))) == cm.ResultErr {
+		unsupported.connect = to.connect
+	}
+	if to.firstByte > 0 && options.SetFirstByteTimeout(cm.Some(types.Duration(to.firstByte))) == cm.ResultErr {
+		unsupported.firstByte = to.firstByte
+	}
+	if to.betweenBytes > 0 && options.SetBetweenBytesTimeout(cm.Some(types.Duration(to.betweenBytes))) == cm.ResultErr {
+		unsupported.betweenBytes = to.betweenBytes
+	}
+	return cm.Some(options), unsupported
+}
+
+// writeRequestBody copies req.Body to w, then finishes w. It closes req.Body.
+// If the body could not be written, the caller must abort w.
+func writeRequestBody(w *bodyWriter, req *http.Request, contentLength int64) error {
+	defer closeBody(req)
+
+	// Only copy from req.Body if it's not nil
+	if req.Body != nil {
+		n, err := io.Copy(w, req.Body)
+		if err != nil {
+			return fmt.Errorf("wasihttp: %w", err)
+		}
+		if contentLength >= 0 && n != contentLength {
+			return fmt.Errorf("wasihttp: ContentLength=%d with Body length %d", contentLength, n)
+		}
+	}
+	if err := w.finish(); err != nil {
+		return fmt.Errorf("wasihttp: %w", err)
+	}
+	return nil
+}
+
+// uploadError returns the error writing a request body, if the upload has
+// failed with an error that [uploadFailed] reports. It does not block.
+func uploadError(uploaded <-chan error) error {
+	select {
+	case err := <-uploaded:
+		if uploadFailed(err) {
+			return err
+		}
+	default:
+	}
+	return nil
+}
+
+// uploadFailed reports whether err is an error writing a request body that
+// should be reported to the caller. Two errors are ignored:
+// [errBodyClosed], as a server may close the request body stream once it
+// has responded, and [context.Canceled], as the upload is canceled when the
+// response completes or fails.
+func uploadFailed(err error) bool {
+	return err != nil && !errors.Is(err, errBodyClosed) && !errors.Is(err, context.Canceled)
+}
+
+// closeBody closes req.Body, if not nil.
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// outgoingRequest returns a new [types.OutgoingRequest] for req.
+// If contentLength is non-negative, a Content-Length header is sent.
+// If requestGzip is true, an Accept-Encoding: gzip header is sent.
+// It returns a [*HeaderError] if the host rejects any header fields.
+func outgoingRequest(req *http.Request, contentLength int64, requestGzip bool) (types.OutgoingRequest, error) {
+	h := make(http.Header, len(req.Header)+2)
+	for k, v := range req.Header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Host", "Content-Length", "Transfer-Encoding", "Trailer":
+			// Set below or derived from other fields of req.
+			continue
+		}
+		h[k] = v
+	}
+	if contentLength >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	if requestGzip {
+		h.Set("Accept-Encoding", "gzip")
+	}
+	if len(req.Trailer) > 0 {
+		keys := make([]string, 0, len(req.Trailer))
+		for k := range req.Trailer {
+			keys = append(keys, http.CanonicalHeaderKey(k))
+		}
+		sort.Strings(keys)
+		h.Set("Trailer", strings.Join(keys, ","))
 	}
-	// TODO: when should an incoming-response be dropped?
-	// defer response.ResourceDrop()
 
-	return incomingResponse(response)
+	headers, err := toFields(h)
+	if err != nil {
+		headers.ResourceDrop()
+		return 0, err
+	}
+	r := types.NewOutgoingRequest(headers)
+	r.SetAuthority(cm.Some(requestAuthority(req))) // TODO: when should this be cm.None?
+	r.SetMethod(toMethod(req.Method))
+	r.SetPathWithQuery(requestPath(req))
+	r.SetScheme(cm.Some(toScheme(req.URL.Scheme))) // TODO: when should this be cm.None?
+	return r, nil
+}
+
+// outgoingLength returns the Content-Length to send for req, or -1 if the
+// length is unknown. It returns an error if req has inconsistent length,
+// body, transfer encoding, or trailers. Requests with trailers are always
+// sent without a Content-Length.
+func outgoingLength(req *http.Request) (int64, error) {
+	for _, te := range req.TransferEncoding {
+		if te != "chunked" {
+			return -1, fmt.Errorf("wasihttp: unsupported transfer encoding: %q", te)
+		}
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		if req.ContentLength != 0 {
+			return -1, fmt.Errorf("wasihttp: Request.ContentLength=%d with nil Body", req.ContentLength)
+		}
+		if len(req.Trailer) > 0 {
+			return -1, errors.New("wasihttp: Request.Trailer with nil Body")
+		}
+		switch req.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			// Servers may require a Content-Length for these methods.
+			return 0, nil
+		}
+		return -1, nil
+	}
+	if req.ContentLength <= 0 || len(req.TransferEncoding) > 0 || len(req.Trailer) > 0 {
+		return -1, nil
+	}
+	return req.ContentLength, nil
 }
 
 func requestAuthority(req *http.Request) string {
@@ -0,0 +1,778 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	outgoinghandler "github.com/ydnar/wasi-http-go/internal/wasi/http/outgoing-handler"
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/poll"
+	"go.bytecodealliance.org/cm"
+)
+
+// TestRoundTripConcurrent tests that concurrent requests are in flight
+// together, so they finish in about the time of the slowest request rather
+// than the sum of all requests.
+func TestRoundTripConcurrent(t *testing.T) {
+	const n = 5
+	const delay = 100 * time.Millisecond
+	h := newFakeHost(t)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		time.Sleep(delay)
+		h.Respond(f, http.StatusOK, nil, r.path)
+	}
+
+	var mu sync.Mutex
+	var handled, maxPollables int
+	setVar(t, &outgoingHandle, func(request outgoinghandler.OutgoingRequest, options cm.Option[outgoinghandler.RequestOptions]) cm.Result[outgoinghandler.ErrorCodeShape, outgoinghandler.FutureIncomingResponse, outgoinghandler.ErrorCode] {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+		return outgoinghandler.Handle(request, options)
+	})
+	setVar(t, &pollAll, func(in cm.List[poll.Pollable]) cm.List[uint32] {
+		mu.Lock()
+		maxPollables = max(maxPollables, int(in.Len()))
+		mu.Unlock()
+		return poll.Poll(in)
+	})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i)
+			req, _ := http.NewRequest("GET", "http://example.com"+path, nil)
+			res, err := new(Transport).RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil || string(b) != path {
+				t.Errorf("got body %q, %v, expected %q", b, err, path)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if elapsed < delay || elapsed > n*delay/2 {
+		t.Errorf("%d requests took %v, expected about %v", n, elapsed, delay)
+	}
+	if handled != n {
+		t.Errorf("got %d requests sent, expected %d", handled, n)
+	}
+	if maxPollables < n {
+		t.Errorf("got at most %d pollables in a call to poll, expected %d waited on together", maxPollables, n)
+	}
+}
+
+// setVar sets *p to v for the duration of the test.
+func setVar[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// TestRoundTripUploadError tests that an error writing the request body,
+// after the host rejects it mid-stream, is returned when reading the response.
+func TestRoundTripUploadError(t *testing.T) {
+	const chunk = 2 * defaultBufferSize
+	h := newFakeHost(t)
+	failed := make(chan struct{})
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		var n int
+		for n < chunk {
+			p, _ := h.Read(r.body.pipe)
+			n += len(p)
+			time.Sleep(50 * time.Microsecond)
+		}
+		h.Fail(r.body.pipe)
+		close(failed)
+		h.WaitBody(r.body)
+		h.Respond(f, http.StatusOK, nil, "partial")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(make([]byte, chunk))
+		<-failed
+		pw.Write(make([]byte, chunk))
+		pw.Close()
+	}()
+	req, _ := http.NewRequest("POST", "http://example.com/", pr)
+	res, err := new(Transport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if string(b) != "partial" {
+		t.Errorf("got body %q, expected %q", b, "partial")
+	}
+	if err == nil || !strings.Contains(err.Error(), "last-operation-failed") {
+		t.Errorf("got error %v, expected the request body write error", err)
+	}
+}
+
+// TestRoundTripErrorClosesBody tests that a request body blocked in Read
+// is closed when RoundTrip fails, so the request body is aborted.
+func TestRoundTripErrorClosesBody(t *testing.T) {
+	h := newFakeHost(t)
+	sent := make(chan *fakeOutgoingRequest, 1)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		sent <- r
+		h.Reject(f, types.ErrorCodeConnectionRefused())
+	}
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", "http://example.com/", pr)
+	_, err := new(Transport).RoundTrip(req)
+	if !errors.Is(err, ErrConnectionRefused) {
+		t.Fatalf("got error %v, expected %v", err, ErrConnectionRefused)
+	}
+	if _, err := pw.Write([]byte("x")); err != io.ErrClosedPipe {
+		t.Errorf("got write error %v, expected %v", err, io.ErrClosedPipe)
+	}
+	r := <-sent
+	h.WaitBody(r.body)
+	if r.body.finished {
+		t.Error("request body finished, expected aborted")
+	}
+}
+
+// TestRoundTripHandleError tests that the request body is dropped if the
+// host rejects the request.
+func TestRoundTripHandleError(t *testing.T) {
+	h := newFakeHost(t)
+	e := types.ErrorCodeHTTPRequestDenied()
+	h.handleErr = &e
+	live := Live[*fakeOutgoingBody](h)
+
+	req, _ := http.NewRequest("POST", "http://example.com/", strings.NewReader("body"))
+	_, err := new(Transport).RoundTrip(req)
+	if !errors.Is(err, ErrHTTPRequestDenied) {
+		t.Fatalf("got error %v, expected %v", err, ErrHTTPRequestDenied)
+	}
+	if n := Live[*fakeOutgoingBody](h); n != live {
+		t.Errorf("got %d live outgoing bodies, expected %d", n, live)
+	}
+}
+
+// TestRoundTripFinalizer tests that an unclosed response body is released
+// when it is garbage collected.
+func TestRoundTripFinalizer(t *testing.T) {
+	h := newFakeHost(t)
+	pipe := &fakePipe{buf: []byte("unread")}
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		h.RespondStreaming(f, http.StatusOK, nil, pipe)
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	res, err := new(Transport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	res = nil
+
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		runtime.GC()
+		h.mu.Lock()
+		dropped := pipe.dropped
+		h.mu.Unlock()
+		if dropped {
+			return
+		}
+	}
+	t.Error("response body not dropped after garbage collection")
+}
+
+func TestRoundTripTLS(t *testing.T) {
+	h := newFakeHost(t)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		h.Respond(f, http.StatusOK, nil, "")
+	}
+	for _, url := range []string{"http://example.com/", "https://example.com:8443/"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		res, err := new(Transport).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if req.URL.Scheme == "http" {
+			if res.TLS != nil {
+				t.Errorf("%s: got TLS %v, expected nil", url, res.TLS)
+			}
+			continue
+		}
+		if res.TLS == nil || res.TLS.ServerName != "example.com" {
+			t.Errorf("%s: got TLS %v, expected server name %q", url, res.TLS, "example.com")
+		}
+	}
+}
+
+func TestOutgoingLength(t *testing.T) {
+	body := func() io.ReadCloser { return io.NopCloser(strings.NewReader("hello")) }
+	tests := []struct {
+		name    string
+		req     *http.Request
+		want    int64
+		wantErr bool
+	}{
+		{"get", &http.Request{Method: "GET"}, -1, false},
+		{"post no body", &http.Request{Method: "POST"}, 0, false},
+		{"post NoBody", &http.Request{Method: "POST", Body: http.NoBody}, 0, false},
+		{"length", &http.Request{Method: "POST", Body: body(), ContentLength: 5}, 5, false},
+		{"unknown length", &http.Request{Method: "POST", Body: body(), ContentLength: -1}, -1, false},
+		{"chunked", &http.Request{Method: "POST", Body: body(), ContentLength: 5, TransferEncoding: []string{"chunked"}}, -1, false},
+		{"trailer", &http.Request{Method: "POST", Body: body(), ContentLength: 5, Trailer: http.Header{"X-Sum": nil}}, -1, false},
+		{"length with nil body", &http.Request{Method: "POST", ContentLength: 5}, -1, true},
+		{"trailer with nil body", &http.Request{Method: "POST", Trailer: http.Header{"X-Sum": nil}}, -1, true},
+		{"gzip", &http.Request{Method: "POST", Body: body(), TransferEncoding: []string{"gzip"}}, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := outgoingLength(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, expected %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRoundTripLengthMismatch tests that a request body shorter than its
+// ContentLength is aborted, and the error is returned from the response body.
+func TestRoundTripLengthMismatch(t *testing.T) {
+	h := newFakeHost(t)
+	aborted := make(chan bool, 1)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		h.WaitBody(r.body)
+		aborted <- r.body.aborted
+		h.Respond(f, http.StatusOK, nil, "")
+	}
+	req, _ := http.NewRequest("POST", "http://example.com/", io.NopCloser(strings.NewReader("hello")))
+	req.ContentLength = 10
+	res, err := new(Transport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if !<-aborted {
+		t.Error("request body finished, expected aborted")
+	}
+	_, err = io.ReadAll(res.Body)
+	if err == nil || !strings.Contains(err.Error(), "ContentLength=10 with Body length 5") {
+		t.Errorf("got error %v, expected a length mismatch", err)
+	}
+}
+
+func TestRoundTripTimeoutOptions(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		h := newFakeHost(t)
+		options := make(chan *fakeRequestOptions, 1)
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			options <- r.options
+			h.Respond(f, http.StatusOK, nil, "")
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := new(Transport).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if o := <-options; o != nil {
+			t.Errorf("got options %+v, expected none", *o)
+		}
+	})
+
+	t.Run("Transport", func(t *testing.T) {
+		h := newFakeHost(t)
+		options := make(chan *fakeRequestOptions, 1)
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			options <- r.options
+			h.Respond(f, http.StatusOK, nil, "")
+		}
+		tr := &Transport{
+			ConnectTimeout:      1 * time.Second,
+			FirstByteTimeout:    2 * time.Second,
+			BetweenBytesTimeout: 3 * time.Second,
+		}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		want := fakeRequestOptions{connect: time.Second, firstByte: 2 * time.Second, betweenBytes: 3 * time.Second}
+		if o := <-options; o == nil || *o != want {
+			t.Errorf("got options %+v, expected %+v", o, want)
+		}
+	})
+
+	// The request context deadline limits the connect and first-byte timeouts.
+	t.Run("context deadline", func(t *testing.T) {
+		h := newFakeHost(t)
+		options := make(chan *fakeRequestOptions, 1)
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			options <- r.options
+			h.Respond(f, http.StatusOK, nil, "")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		tr := &Transport{FirstByteTimeout: time.Minute, BetweenBytesTimeout: time.Minute}
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://example.com/", nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		o := <-options
+		if o == nil {
+			t.Fatal("got no options")
+		}
+		if o.connect <= 0 || o.connect > time.Second || o.firstByte != o.connect {
+			t.Errorf("got connect %v and first-byte %v, expected the same timeout ≤ 1s", o.connect, o.firstByte)
+		}
+		if o.betweenBytes != time.Minute {
+			t.Errorf("got between-bytes %v, expected %v", o.betweenBytes, time.Minute)
+		}
+	})
+}
+
+// TestRoundTripGuestTimeout tests that timeouts the host rejects are
+// enforced by the guest.
+func TestRoundTripGuestTimeout(t *testing.T) {
+	t.Run("first-byte", func(t *testing.T) {
+		h := newFakeHost(t)
+		h.noOptions = map[string]bool{"first-byte": true}
+		options := make(chan *fakeRequestOptions, 1)
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			options <- r.options // never responds
+		}
+		tr := &Transport{FirstByteTimeout: 10 * time.Millisecond}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		start := time.Now()
+		_, err := tr.RoundTrip(req)
+		if !errors.Is(err, ErrHTTPResponseTimeout) {
+			t.Fatalf("got %v, expected %v", err, ErrHTTPResponseTimeout)
+		}
+		if d := time.Since(start); d < 10*time.Millisecond {
+			t.Errorf("timed out after %v, expected at least 10ms", d)
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("got %v, expected Timeout() true", err)
+		}
+		if o := <-options; o == nil || o.firstByte != 0 {
+			t.Errorf("got options %+v, expected no first-byte timeout", o)
+		}
+	})
+
+	t.Run("between-bytes", func(t *testing.T) {
+		h := newFakeHost(t)
+		h.noOptions = map[string]bool{"between-bytes": true}
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			h.RespondStreaming(f, http.StatusOK, nil, &fakePipe{buf: []byte("partial")}) // never closed
+		}
+		tr := &Transport{BetweenBytesTimeout: 10 * time.Millisecond}
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if string(b) != "partial" {
+			t.Errorf("got body %q, expected %q", b, "partial")
+		}
+		if !errors.Is(err, ErrConnectionReadTimeout) {
+			t.Fatalf("got %v, expected %v", err, ErrConnectionReadTimeout)
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Errorf("got %v, expected Timeout() true", err)
+		}
+	})
+}
+
+// TestTransportConformance tests that responses from Transport match those
+// from [http.Transport] for the same exchange. The fake host responds with
+// the status, header, body, and trailers received by [http.Transport].
+func TestTransportConformance(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{
+			name:   "Content-Length",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				w.Write([]byte("hello"))
+			},
+		},
+		{
+			name:   "empty",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "0")
+			},
+		},
+		{
+			name:   "chunked",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello, "))
+				w.(http.Flusher).Flush()
+				w.Write([]byte("world"))
+			},
+		},
+		{
+			name:   "HEAD",
+			method: "HEAD",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+			},
+		},
+		{
+			name:   "204",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			name:   "304",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(http.StatusNotModified)
+			},
+		},
+		{
+			name:   "Connection: close",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Connection", "close")
+				w.Write([]byte("bye"))
+			},
+		},
+		{
+			name:   "trailers",
+			method: "GET",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				w.Write([]byte("body"))
+				w.Header().Set("X-Checksum", "abc")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			tr := &http.Transport{}
+			defer tr.CloseIdleConnections()
+			req, _ := http.NewRequest(tt.method, srv.URL+"/path", nil)
+			want, wantBody, wantDeclared := roundTrip(t, tr, req)
+
+			// Respond from the fake host as the server did on the wire.
+			h := newFakeHost(t)
+			h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+				header := want.Header.Clone()
+				if slices.Contains(want.TransferEncoding, "chunked") {
+					header.Set("Transfer-Encoding", "chunked")
+				}
+				if want.Close {
+					header.Set("Connection", "close")
+				}
+				for k := range wantDeclared {
+					header.Add("Trailer", k)
+				}
+				h.RespondStreaming(f, want.StatusCode, header, &fakePipe{buf: wantBody, closed: true})
+				if len(want.Trailer) > 0 {
+					h.mu.Lock()
+					f.res.body.trailers = want.Trailer.Clone()
+					h.mu.Unlock()
+				}
+			}
+			req, _ = http.NewRequest(tt.method, srv.URL+"/path", nil)
+			got, gotBody, gotDeclared := roundTrip(t, new(Transport), req)
+
+			if got.Status != want.Status || got.StatusCode != want.StatusCode {
+				t.Errorf("Status: got %q, expected %q", got.Status, want.Status)
+			}
+			if got.Proto != want.Proto || got.ProtoMajor != want.ProtoMajor || got.ProtoMinor != want.ProtoMinor {
+				t.Errorf("Proto: got %q, expected %q", got.Proto, want.Proto)
+			}
+			if !reflect.DeepEqual(got.Header, want.Header) {
+				t.Errorf("Header: got %v, expected %v", got.Header, want.Header)
+			}
+			if got.ContentLength != want.ContentLength {
+				t.Errorf("ContentLength: got %d, expected %d", got.ContentLength, want.ContentLength)
+			}
+			if !slices.Equal(got.TransferEncoding, want.TransferEncoding) {
+				t.Errorf("TransferEncoding: got %q, expected %q", got.TransferEncoding, want.TransferEncoding)
+			}
+			if got.Close != want.Close {
+				t.Errorf("Close: got %t, expected %t", got.Close, want.Close)
+			}
+			if got.Request != req {
+				t.Errorf("Request: got %p, expected %p", got.Request, req)
+			}
+			// A nil Trailer is equivalent to an empty one.
+			if !equalTrailer(gotDeclared, wantDeclared) {
+				t.Errorf("Trailer before EOF: got %v, expected %v", gotDeclared, wantDeclared)
+			}
+			if !equalTrailer(got.Trailer, want.Trailer) {
+				t.Errorf("Trailer: got %v, expected %v", got.Trailer, want.Trailer)
+			}
+			if (got.Body == http.NoBody) != (want.Body == http.NoBody) {
+				t.Errorf("Body: got %T, expected %T", got.Body, want.Body)
+			}
+			if !bytes.Equal(gotBody, wantBody) {
+				t.Errorf("Body: got %q, expected %q", gotBody, wantBody)
+			}
+		})
+	}
+}
+
+// roundTrip sends req with rt, and returns the response, its body, and its
+// Trailer before the body was read. The body of the returned response is closed.
+func roundTrip(t *testing.T, rt http.RoundTripper, req *http.Request) (*http.Response, []byte, http.Header) {
+	t.Helper()
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	declared := res.Trailer.Clone()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, b, declared
+}
+
+func equalTrailer(a, b http.Header) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func TestRoundTripGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello, gzip"))
+	zw.Close()
+	compressed := buf.String()
+	corrupt := []byte(compressed)
+	corrupt[len(corrupt)-5] ^= 0xff // CRC-32
+
+	tests := []struct {
+		name           string
+		transport      *Transport
+		acceptEncoding string // sent by the caller
+		body           string // gzip-encoded response body
+		wantAccept     string // Accept-Encoding received by the host
+		wantBody       string
+		wantDecoded    bool
+		wantErr        error
+	}{
+		{
+			name:        "decoded",
+			transport:   &Transport{},
+			body:        compressed,
+			wantAccept:  "gzip",
+			wantBody:    "hello, gzip",
+			wantDecoded: true,
+		},
+		{
+			name:           "requested by caller",
+			transport:      &Transport{},
+			acceptEncoding: "gzip",
+			body:           compressed,
+			wantAccept:     "gzip",
+			wantBody:       compressed,
+		},
+		{
+			name:       "DisableCompression",
+			transport:  &Transport{DisableCompression: true},
+			body:       compressed,
+			wantAccept: "",
+			wantBody:   compressed,
+		},
+		{
+			name:        "corrupt",
+			transport:   &Transport{},
+			body:        string(corrupt),
+			wantAccept:  "gzip",
+			wantDecoded: true,
+			wantErr:     ErrHTTPResponseContentCoding,
+		},
+		{
+			name:        "truncated",
+			transport:   &Transport{},
+			body:        compressed[:len(compressed)/2],
+			wantAccept:  "gzip",
+			wantDecoded: true,
+			wantErr:     ErrHTTPResponseContentCoding,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newFakeHost(t)
+			accept := make(chan string, 1)
+			h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+				accept <- r.header.Get("Accept-Encoding")
+				h.Respond(f, http.StatusOK, http.Header{
+					"Content-Encoding": {"gzip"},
+					"Content-Length":   {strconv.Itoa(len(tt.body))},
+				}, tt.body)
+			}
+			req, _ := http.NewRequest("GET", "http://example.com/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			res, err := tt.transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if got := <-accept; got != tt.wantAccept {
+				t.Errorf("Accept-Encoding: got %q, expected %q", got, tt.wantAccept)
+			}
+			if res.Uncompressed != tt.wantDecoded {
+				t.Errorf("Uncompressed: got %t, expected %t", res.Uncompressed, tt.wantDecoded)
+			}
+			if tt.wantDecoded {
+				if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Length") != "" || res.ContentLength != -1 {
+					t.Errorf("got header %v and ContentLength %d, expected no Content-Encoding or Content-Length", res.Header, res.ContentLength)
+				}
+			} else if res.Header.Get("Content-Encoding") != "gzip" || res.ContentLength != int64(len(tt.body)) {
+				t.Errorf("got header %v and ContentLength %d, expected them unchanged", res.Header, res.ContentLength)
+			}
+			b, err := io.ReadAll(res.Body)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, expected %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantBody {
+				t.Errorf("got body %q, expected %q", b, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRoundTripHeaderError(t *testing.T) {
+	h := newFakeHost(t)
+	h.forbidden = map[string]bool{"x-forbidden": true, "x-blocked": true}
+	live := Live[*fakeFields](h)
+
+	body := &closeRecorder{Reader: strings.NewReader("body")}
+	req, _ := http.NewRequest("POST", "http://example.com/", body)
+	req.Header.Set("X-Forbidden", "1")
+	req.Header.Set("X-Blocked", "1")
+	req.Header.Set("X-Allowed", "1")
+	req.Header["X-Invalid"] = []string{"a\r\nb"}
+	_, err := new(Transport).RoundTrip(req)
+	var herr *HeaderError
+	if !errors.As(err, &herr) {
+		t.Fatalf("got error %v, expected a *HeaderError", err)
+	}
+	want := []FieldError{
+		{Name: "X-Blocked", Reason: "forbidden"},
+		{Name: "X-Forbidden", Reason: "forbidden"},
+		{Name: "X-Invalid", Reason: "invalid-syntax"},
+	}
+	if !reflect.DeepEqual(herr.Fields, want) {
+		t.Errorf("got fields %v, expected %v", herr.Fields, want)
+	}
+	if n := h.Calls("handle"); n != 0 {
+		t.Errorf("got %d requests sent to the host, expected 0", n)
+	}
+	if !body.closed {
+		t.Error("request body not closed")
+	}
+	if n := Live[*fakeFields](h); n != live {
+		t.Errorf("got %d live fields, expected %d", n, live)
+	}
+}
+
+// TestRoundTripHopHeaders tests that hop-by-hop request header fields are
+// not sent to the host, which forbids them.
+func TestRoundTripHopHeaders(t *testing.T) {
+	h := newFakeHost(t)
+	h.forbidden = map[string]bool{
+		"connection":       true,
+		"keep-alive":       true,
+		"proxy-connection": true,
+		"te":               true,
+		"upgrade":          true,
+		"x-hop":            true,
+	}
+	sent := make(chan http.Header, 1)
+	h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+		sent <- r.header
+		h.Respond(f, http.StatusOK, nil, "")
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-End-To-End", "1")
+	res, err := new(Transport).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	want := http.Header{"Accept-Encoding": {"gzip"}, "X-End-To-End": {"1"}}
+	if got := <-sent; !reflect.DeepEqual(got, want) {
+		t.Errorf("got header %v, expected %v", got, want)
+	}
+}
+
+// closeRecorder records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
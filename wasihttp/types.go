@@ -1,39 +1,172 @@
 package wasihttp
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/poll"
 	"github.com/ydnar/wasi-http-go/internal/wasi/io/streams"
 	"go.bytecodealliance.org/cm"
 )
 
-func incomingRequest(req types.IncomingRequest) (*http.Request, error) {
+// incomingRequest returns an [http.Request] for req. If req is invalid, it
+// returns the request with an empty body, and an error.
+func incomingRequest(ctx context.Context, req types.IncomingRequest, remoteAddrHeader string) (*http.Request, error) {
 	r := &http.Request{
 		Method: fromMethod(req.Method()),
 		URL:    incomingURL(req),
-		// TODO: Proto, ProtoMajor, ProtoMinor
-		Header: fromFields(req.Headers()),
-		Host:   req.Authority().Value(),
+		// wasi-http does not expose the protocol version.
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     fromFields(req.Headers()),
+		Host:       req.Authority().Value(),
+		RequestURI: req.PathWithQuery().Value(),
+		Body:       http.NoBody,
+	}
+	r = r.WithContext(ctx)
+
+	var err error
+	r.ContentLength, r.TransferEncoding, err = incomingLength(r.Method, r.Header)
+	if err != nil {
+		return r, err
+	}
+	if remoteAddrHeader != "" {
+		r.RemoteAddr = remoteAddr(r.Header, remoteAddrHeader)
+	}
+	if r.URL.Scheme == "https" {
+		r.TLS = tlsState(r.URL.Hostname())
 	}
 
 	body, _, isErr := req.Consume().Result()
 	if isErr {
-		return nil, errors.New("error consuming wasi-http request")
+		return r, errors.New("wasihttp: error consuming wasi-http request")
 	}
+	track("incoming-body")
 
-	r.Body = newBodyReader(body, func(h http.Header) {
+	b := newBodyReader(body, func(h http.Header) {
 		r.Trailer = h
 	})
+	b.ctx = ctx
+	r.Body = b
 
 	return r, nil
 }
 
+// tlsState returns the TLS connection state reported for an https request
+// or response. TLS is terminated by the host, so only the server name is known.
+func tlsState(serverName string) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		HandshakeComplete: true,
+		ServerName:        serverName,
+	}
+}
+
+// incomingLength returns the length and transfer encoding of a request body
+// from its headers. If the body is chunked, the Transfer-Encoding and
+// Content-Length headers are removed from h.
+// A length of -1 means the length is unknown.
+func incomingLength(method string, h http.Header) (int64, []string, error) {
+	var te []string
+	if v := h.Get("Transfer-Encoding"); v != "" {
+		if !strings.EqualFold(v, "chunked") {
+			return -1, nil, fmt.Errorf("wasihttp: unsupported transfer encoding: %q", v)
+		}
+		te = []string{"chunked"}
+		h.Del("Transfer-Encoding")
+		// As with net/http, chunked encoding overrides Content-Length,
+		// which is removed so it is not mistaken for the body length.
+		h.Del("Content-Length")
+	}
+	if te == nil {
+		n, err := contentLength(h)
+		if err != nil || n >= 0 {
+			return n, nil, err
+		}
+		if method == http.MethodGet || method == http.MethodHead {
+			return 0, nil, nil
+		}
+	}
+	return -1, te, nil
+}
+
+// contentLength parses the Content-Length header in h.
+// It returns -1 if h does not have a Content-Length header.
+func contentLength(h http.Header) (int64, error) {
+	cl := h.Values("Content-Length")
+	if len(cl) == 0 {
+		return -1, nil
+	}
+	// Multiple identical values are allowed by RFC 9110, section 8.6.
+	for _, v := range cl[1:] {
+		if v != cl[0] {
+			return -1, fmt.Errorf("wasihttp: conflicting Content-Length headers: %q", cl)
+		}
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(cl[0]), 10, 63)
+	if err != nil {
+		return -1, fmt.Errorf("wasihttp: invalid Content-Length: %q", cl[0])
+	}
+	return int64(n), nil
+}
+
+// remoteAddr returns the client address from header name in h, set by a
+// trusted proxy. For headers with a list of addresses, such as
+// X-Forwarded-For, the last (nearest) address is used. Forwarded headers
+// (RFC 7239) are parsed for their "for" parameter.
+// As with net/http, the address is returned as host:port. If the header
+// does not include a port, port 0 is used.
+func remoteAddr(h http.Header, name string) string {
+	vals := h.Values(name)
+	if len(vals) == 0 {
+		return ""
+	}
+	last := vals[len(vals)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	last = strings.TrimSpace(last)
+	if http.CanonicalHeaderKey(name) != "Forwarded" {
+		return hostPort(last)
+	}
+	for _, param := range strings.Split(last, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(k, "for") {
+			return hostPort(strings.Trim(v, `"`))
+		}
+	}
+	return ""
+}
+
+// hostPort returns addr as host:port, adding port 0 if addr has no port.
+// IPv6 addresses may be bracketed, with or without a port.
+func hostPort(addr string) string {
+	if addr == "" {
+		return ""
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[1 : len(addr)-1]
+	}
+	return net.JoinHostPort(addr, "0")
+}
+
 func fromMethod(m types.Method) string {
 	if o := m.Other(); o != nil {
 		return strings.ToUpper(*o)
@@ -57,29 +190,138 @@ func fromScheme(s types.Scheme) string {
 	return strings.ToLower(s.String())
 }
 
-func incomingResponse(res types.IncomingResponse) (*http.Response, error) {
+func incomingResponse(req *http.Request, res types.IncomingResponse) (*http.Response, error) {
+	code := int(res.Status())
 	r := &http.Response{
-		Status:     http.StatusText(int(res.Status())),
-		StatusCode: int(res.Status()),
+		Status:     responseStatus(code),
+		StatusCode: code,
+		// wasi-http does not expose the protocol version.
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
 		Header:     fromFields(res.Headers()),
+		Request:    req,
+	}
+
+	var err error
+	r.ContentLength, r.TransferEncoding, err = responseLength(req.Method, code, r.Header)
+	if err != nil {
+		return nil, err
+	}
+	// As with net/http, Connection: close is reported in Close, and declared
+	// trailers are moved from Header to Trailer, until their values are read.
+	if headerHasToken(r.Header, "Connection", "close") {
+		r.Close = true
+		r.Header.Del("Connection")
+	}
+	r.Trailer = declaredTrailer(r.Header)
+	if req.URL.Scheme == "https" {
+		r.TLS = tlsState(req.URL.Hostname())
 	}
 
 	body, _, isErr := res.Consume().Result()
 	if isErr {
 		return nil, errors.New("error consuming wasi-http response")
 	}
+	track("incoming-body")
 
-	r.Body = newBodyReader(body, func(h http.Header) { r.Trailer = h })
+	// Trailer is filled in when the body reaches EOF. The body refers to the
+	// map rather than to r, so it can be garbage collected without forming a
+	// cycle with r.
+	trailer := r.Trailer
+	r.Body = newBodyReader(body, func(h http.Header) { maps.Copy(trailer, h) })
 
 	return r, nil
 }
 
-var _ io.ReadCloser = &bodyReader{}
+// declaredTrailer removes the Trailer header from h, and returns a non-nil
+// map with a nil value for each trailer it declares.
+func declaredTrailer(h http.Header) http.Header {
+	trailer := make(http.Header)
+	for _, v := range h.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			switch k {
+			case "", "Transfer-Encoding", "Trailer", "Content-Length":
+				continue // not allowed as trailers
+			}
+			trailer[k] = nil
+		}
+	}
+	h.Del("Trailer")
+	return trailer
+}
+
+// responseStatus returns the status text for code, e.g. "200 OK".
+func responseStatus(code int) string {
+	s := strconv.Itoa(code)
+	if text := http.StatusText(code); text != "" {
+		s += " " + text
+	}
+	return s
+}
+
+// responseLength returns the length and transfer encoding of a response body
+// from its headers, following the same rules as [net/http], and removes any
+// Transfer-Encoding header from h. A length of -1 means the length is unknown.
+func responseLength(method string, code int, h http.Header) (int64, []string, error) {
+	switch {
+	case method == http.MethodHead:
+		n, err := contentLength(h)
+		if err != nil {
+			n = -1
+		}
+		return n, nil, nil
+	case code/100 == 1, code == http.StatusNoContent, code == http.StatusNotModified:
+		return 0, nil, nil
+	}
+	if v := h.Get("Transfer-Encoding"); v != "" {
+		if !strings.EqualFold(v, "chunked") {
+			return -1, nil, fmt.Errorf("wasihttp: unsupported transfer encoding: %q", v)
+		}
+		h.Del("Transfer-Encoding")
+		h.Del("Content-Length")
+		return -1, []string{"chunked"}, nil
+	}
+	n, err := contentLength(h)
+	return n, nil, err
+}
+
+// headerHasToken reports whether the comma-separated header key in h
+// contains token, ignoring case.
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	_ io.ReadCloser = &bodyReader{}
+	_ io.ByteReader = &bodyReader{}
+	_ io.WriterTo   = &bodyReader{}
+)
 
+// bodyReader reads an incoming-body. Its owner must finish or abort it to
+// release its host resources: the Server does so when a handler returns,
+// and the Transport sets a finalizer on each response body.
 type bodyReader struct {
 	body     types.IncomingBody
 	trailer  func(http.Header)
+	done     func() error // optional, called when the body is finished
 	stream   streams.InputStream
+	poll     poll.Pollable   // subscribed to stream on first blocking read
+	buf      []byte          // data read from stream but not yet returned
+	ctx      context.Context // aborts pending reads when done
+	deadline time.Time       // zero means no deadline
+	timeout  time.Duration   // if non-zero, the maximum time to wait for data
+	limit    int64           // if positive, the maximum number of bytes to read
+	n        int64           // number of bytes read from stream
+	err      error           // sticky error, returned after buf is drained
 	finished bool
 }
 
@@ -87,64 +329,201 @@ func newBodyReader(body types.IncomingBody, trailer func(http.Header)) *bodyRead
 	return &bodyReader{
 		body:    body,
 		trailer: trailer,
+		ctx:     context.Background(),
 	}
 }
 
-// TODO: implement buffered reads
+// Read reads buffered data into p. If no data is buffered, Read reads up to
+// max(len(p), [defaultBufferSize]) bytes from the stream, blocking only if
+// no data is available.
 func (r *bodyReader) Read(p []byte) (int, error) {
-	if r.finished {
-		return 0, http.ErrBodyReadAfterClose
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(r.buf) == 0 {
+		if err := r.fill(max(len(p), defaultBufferSize)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// ReadByte implements [io.ByteReader].
+func (r *bodyReader) ReadByte() (byte, error) {
+	if len(r.buf) == 0 {
+		if err := r.fill(defaultBufferSize); err != nil {
+			return 0, err
+		}
+	}
+	c := r.buf[0]
+	r.buf = r.buf[1:]
+	return c, nil
+}
+
+// fill reads up to n bytes from the stream into r.buf, which must be empty.
+// It first attempts a non-blocking read, and waits for the stream only if
+// no data is available.
+func (r *bodyReader) fill(n int) error {
+	if err := r.open(); err != nil {
+		return err
+	}
+	if pastDeadline(r.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	if r.limit > 0 {
+		// Read one byte past the limit to detect an oversized body.
+		n = int(min(int64(n), r.limit-r.n+1))
 	}
+	for {
+		list, err, isErr := r.stream.Read(uint64(n)).Result()
+		if isErr {
+			if err.Closed() {
+				return r.eof()
+			}
+			return fmt.Errorf("wasihttp: failed to read from InputStream: %s", streamErrorString(err))
+		}
+		if list.Len() > 0 {
+			r.buf = list.Slice()
+			r.n += int64(len(r.buf))
+			if r.limit > 0 && r.n > r.limit {
+				r.buf = r.buf[:len(r.buf)-int(r.n-r.limit)]
+				r.err = &Error{types.ErrorCodeHTTPRequestBodySize(cm.Some(uint64(r.n)))}
+				if len(r.buf) == 0 {
+					return r.err
+				}
+			}
+			return nil
+		}
+		if err := r.wait(); err != nil {
+			return err
+		}
+	}
+}
 
+// open opens the stream, if not already open.
+// It returns an error if the body is closed or at EOF.
+func (r *bodyReader) open() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.finished {
+		return http.ErrBodyReadAfterClose
+	}
 	if r.stream == cm.ResourceNone {
 		// the first call should always return OK
 		r.stream, _, _ = r.body.Stream().Result()
+		track("input-stream")
 	}
+	return nil
+}
 
-	// TODO: coordinate with runtime to block on multiple pollables.
-	poll := r.stream.Subscribe()
-	poll.Block()
-	poll.ResourceDrop()
-
-	list, err, isErr := r.stream.Read(uint64(len(p))).Result()
-	if isErr {
-		if err.Closed() {
-			err2 := r.finish() // read trailers
-			if err2 != nil {
-				return 0, err2
-			}
-			return 0, io.EOF
+// wait blocks until the stream has data available, r.deadline passes,
+// r.timeout elapses, or r.ctx is done. If r.ctx is done, the body is aborted.
+func (r *bodyReader) wait() error {
+	if r.poll == cm.ResourceNone {
+		r.poll = r.stream.Subscribe()
+		track("pollable")
+	}
+	deadline := r.deadline
+	var idle bool
+	if r.timeout > 0 {
+		d := time.Now().Add(r.timeout)
+		if deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			idle = true
 		}
-		return 0, fmt.Errorf("failed to read from InputStream %s", err.LastOperationFailed().ToDebugString())
 	}
+	err := await(r.ctx, r.poll, deadline)
+	switch {
+	case err == nil:
+		return nil
+	case idle && err == os.ErrDeadlineExceeded:
+		return &Error{types.ErrorCodeConnectionReadTimeout()}
+	case r.ctx.Err() != nil || err == context.DeadlineExceeded:
+		r.abort(err)
+	}
+	return err
+}
+
+// abort drops the body without reading its trailers, which signals the host
+// that the rest of the body is not needed. Subsequent reads return err.
+// It returns the result of r.done, if called.
+func (r *bodyReader) abort(err error) error {
+	r.err = err
+	r.buf = nil
+	if r.finished {
+		return nil
+	}
+	r.finished = true
+	r.dropStream()
+	r.body.ResourceDrop()
+	untrack("incoming-body")
+	if r.done != nil {
+		return r.done()
+	}
+	return nil
+}
+
+// eof finishes the body after the stream is closed, and returns
+// io.EOF, or an error if the trailers could not be read.
+func (r *bodyReader) eof() error {
+	r.err = r.finish() // read trailers
+	if r.err == nil {
+		r.err = io.EOF
+	}
+	return r.err
+}
 
-	copy(p, list.Slice())
-	return int(list.Len()), nil
+// WriteTo implements [io.WriterTo]. If w is backed by a wasi stream,
+// data is spliced by the host without copying it into guest memory.
+func (r *bodyReader) WriteTo(w io.Writer) (int64, error) {
+	switch w := w.(type) {
+	case *bodyWriter:
+		return splice(w, r)
+	case *responseWriter:
+		return w.ReadFrom(r)
+	}
+	return io.Copy(w, readerOnly{r})
 }
 
+// Close closes the body. If the body has not been read to EOF, the rest of
+// the body is discarded by the host rather than read, and its trailers are
+// not available.
 func (r *bodyReader) Close() error {
-	return r.finish()
+	return r.abort(http.ErrBodyReadAfterClose)
 }
 
-func (r *bodyReader) finish() error {
+func (r *bodyReader) finish() (err error) {
 	if r.finished {
 		return nil
 	}
 	r.finished = true
-	if r.stream != cm.ResourceNone {
-		r.stream.ResourceDrop()
+	if r.done != nil {
+		defer func() {
+			if err2 := r.done(); err == nil {
+				err = err2
+			}
+		}()
 	}
+	r.dropStream()
 
 	future := types.IncomingBodyFinish(r.body)
-	defer future.ResourceDrop()
+	untrack("incoming-body")
+	track("future-trailers")
+	defer func() {
+		future.ResourceDrop()
+		untrack("future-trailers")
+	}()
 	p := future.Subscribe()
-	p.Block()
+	await(context.Background(), p, time.Time{})
 	p.ResourceDrop()
 	trailersReady := future.Get()
 	// TODO: figure out a better way to handle option<result<result<option<trailers>, error-code>>>
-	someTrailers, err, isErr := trailersReady.Some().OK().Result()
+	someTrailers, errCode, isErr := trailersReady.Some().OK().Result()
 	if isErr {
-		return errors.New(err.String())
+		return &Error{errCode}
 	}
 	trailers := someTrailers.Some()
 	if trailers != nil {
@@ -154,77 +533,391 @@ func (r *bodyReader) finish() error {
 	return nil
 }
 
+// dropStream drops the stream and its pollable, if any.
+func (r *bodyReader) dropStream() {
+	if r.poll != cm.ResourceNone {
+		r.poll.ResourceDrop() // must be dropped before its parent stream
+		untrack("pollable")
+	}
+	if r.stream != cm.ResourceNone {
+		r.stream.ResourceDrop()
+		untrack("input-stream")
+	}
+}
+
 var (
-	_ io.Writer    = &bodyWriter{}
-	_ http.Flusher = &bodyWriter{}
+	_ io.Writer     = &bodyWriter{}
+	_ io.ReaderFrom = &bodyWriter{}
+	_ http.Flusher  = &bodyWriter{}
 )
 
+// defaultBufferSize is the default size of the buffer used by [bodyWriter].
+const defaultBufferSize = 4096
+
+// bodyWriter writes an outgoing-body. Its owner must finish or abort it to
+// release its host resources: the Server does so when a handler returns,
+// and the Transport once the request body is written or the request fails.
 type bodyWriter struct {
 	body     types.OutgoingBody
 	trailer  func() http.Header
+	closed   func() // optional, called when the stream is closed before all data is written
 	stream   streams.OutputStream
+	buf      []byte          // data not yet written to stream
+	ctx      context.Context // aborts pending writes when done
+	deadline time.Time       // zero means no deadline
+	err      error           // sticky error from the stream
 	finished bool
 }
 
+// errBodyClosed is returned when writing to a body stream that was closed
+// by the host before all data was written.
+var errBodyClosed = errors.New("wasihttp: body stream closed")
+
 // newBodyWriter takes ownership of body, allowing it to be written to.
+// Writes are buffered in a buffer of size bytes, or [defaultBufferSize] if size <= 0.
 // Call finish to send the HTTP trailers provided by the trailer callback.
-func newBodyWriter(body types.OutgoingBody, trailer func() http.Header) *bodyWriter {
+func newBodyWriter(body types.OutgoingBody, size int, trailer func() http.Header) *bodyWriter {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	track("outgoing-body")
 	return &bodyWriter{
 		body:    body,
 		trailer: trailer,
+		buf:     make([]byte, 0, size),
+		ctx:     context.Background(),
 	}
 }
 
-// TODO: buffer writes
+// Write writes p to the buffer. Data is written to the stream
+// only when the buffer is full, or when Flush or finish is called.
+// Writes larger than the buffer are written directly to the stream.
+// If the stream is closed before all of p is accepted, Write returns the
+// number of bytes of p that were accepted and a non-nil error.
 func (w *bodyWriter) Write(p []byte) (n int, err error) {
-	if w.stream == cm.ResourceNone {
-		w.stream, _, _ = w.body.Write().Result()
+	if w.finished {
+		return 0, errors.New("wasihttp: write after close")
 	}
-	res := w.stream.BlockingWriteAndFlush(cm.ToList(p))
-	if res.IsErr() {
-		// The stream can be closed as soon as the planned "Content-Length" data
-		// has been flushed on the stream. But in wasmtime, after each flush we
-		// check if we can write to the stream. This can sometimes throw "closed"
-		// stream error.
-		//
-		// Refer to https://github.com/WebAssembly/wasi-io/issues/109 for more details.
-		if !res.Err().Closed() {
-			return 0, fmt.Errorf("wasihttp: %v", res.Err())
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(p) > 0 {
+		if len(w.buf) == 0 && len(p) >= cap(w.buf) {
+			m, err := w.writeStream(p)
+			return n + m, err
+		}
+		buffered := len(w.buf)
+		c := copy(w.buf[buffered:cap(w.buf)], p)
+		w.buf = w.buf[:buffered+c]
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			m, err := w.writeStream(w.buf)
+			w.buf = w.buf[:0]
+			if err != nil {
+				// Only count the bytes from p that reached the stream.
+				return n + max(0, m-buffered), err
+			}
 		}
+		n += c
 	}
-	return len(p), nil
+	return n, nil
 }
 
-// TODO: buffer writes
+// Flush implements [http.Flusher].
 func (w *bodyWriter) Flush() {
+	w.flush()
+}
+
+func (w *bodyWriter) flush() error {
 	if w.finished {
-		return
+		return errors.New("wasihttp: flush after close")
 	}
-	if w.stream != cm.ResourceNone {
-		w.stream.Flush()
+	if err := w.writeBuffer(); err != nil {
+		return err
+	}
+	return w.flushStream()
+}
+
+// writeBuffer writes any buffered data to the stream.
+func (w *bodyWriter) writeBuffer() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.writeStream(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// writeStream writes p to the stream, in chunks sized to the stream’s
+// check-write budget, waiting for the stream as needed.
+// It returns the number of bytes accepted by the stream.
+func (w *bodyWriter) writeStream(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if pastDeadline(w.deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	w.open()
+	for len(p) > 0 {
+		budget, serr, isErr := w.stream.CheckWrite().Result()
+		if isErr {
+			return n, w.streamError(serr)
+		}
+		if budget == 0 {
+			if err := w.wait(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		chunk := p[:min(budget, uint64(len(p)))]
+		res := w.stream.Write(cm.ToList(chunk))
+		if res.IsErr() {
+			return n, w.streamError(*res.Err())
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// open opens the stream, if not already open.
+func (w *bodyWriter) open() {
+	if w.stream == cm.ResourceNone {
+		w.stream, _, _ = w.body.Write().Result() // the first call should always return OK
+		track("output-stream")
+	}
+}
+
+// ReadFrom implements [io.ReaderFrom]. If src is a wasi-http body, data is
+// spliced by the host without copying it into guest memory.
+func (w *bodyWriter) ReadFrom(src io.Reader) (int64, error) {
+	if r, ok := src.(*bodyReader); ok {
+		return splice(w, r)
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+// splice copies data from r to w until r reaches EOF, using the host to
+// splice data between streams. Any data buffered in r or w is written first.
+func splice(w *bodyWriter, r *bodyReader) (n int64, err error) {
+	if w.finished {
+		return 0, errors.New("wasihttp: write after close")
+	}
+	if r.limit > 0 {
+		// Limited bodies are read by the guest to count their bytes.
+		return io.Copy(writerOnly{w}, readerOnly{r})
+	}
+	if len(r.buf) > 0 {
+		m, err := w.Write(r.buf)
+		r.buf = r.buf[m:]
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	if err := w.writeBuffer(); err != nil {
+		return n, err
+	}
+	if err := r.open(); err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if w.err != nil {
+		return n, w.err
+	}
+	if pastDeadline(w.deadline) || pastDeadline(r.deadline) {
+		return n, os.ErrDeadlineExceeded
+	}
+	w.open()
+	for {
+		budget, serr, isErr := w.stream.CheckWrite().Result()
+		if isErr {
+			return n, spliceError(w, r, serr)
+		}
+		if budget == 0 {
+			if err := w.wait(); err != nil {
+				return n, err
+			}
+			continue
+		}
+		m, serr, isErr := w.stream.Splice(r.stream, budget).Result()
+		if isErr {
+			if !serr.Closed() {
+				return n, errors.New("wasihttp: " + streamErrorString(serr))
+			}
+			// Either stream may be closed. Check the output stream first.
+			if _, serr, isErr := w.stream.CheckWrite().Result(); isErr {
+				return n, spliceError(w, r, serr)
+			}
+			if err := r.eof(); err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		}
+		n += int64(m)
+		if m == 0 {
+			if err := r.wait(); err != nil {
+				return n, err
+			}
+		}
 	}
 }
 
+// spliceError returns the error for a failed write to w while splicing from r.
+// Like flushError, it tolerates a closed output stream if no data was refused:
+// the host may close the stream once the planned "Content-Length" data has been
+// written, before r reports EOF. A blocking read on r tells the two cases apart.
+// Any data read from r remains buffered in r.
+func spliceError(w *bodyWriter, r *bodyReader, err streams.StreamError) error {
+	if !err.Closed() {
+		return w.streamError(err)
+	}
+	switch rerr := r.fill(1); rerr {
+	case nil:
+		return w.streamError(err)
+	case io.EOF:
+		return nil
+	default:
+		return rerr
+	}
+}
+
+// streamErrorString returns a description of err, including the debug string
+// of a last-operation-failed error, whose wasi:io/error resource is dropped.
+func streamErrorString(err streams.StreamError) string {
+	e := err.LastOperationFailed()
+	if e == nil {
+		return err.String()
+	}
+	track("io-error")
+	defer func() {
+		e.ResourceDrop()
+		untrack("io-error")
+	}()
+	return err.String() + ": " + e.ToDebugString()
+}
+
+// readerOnly hides any methods other than Read, to prevent recursion in io.Copy.
+type readerOnly struct {
+	io.Reader
+}
+
+// writerOnly hides any methods other than Write, to prevent recursion in io.Copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// flushStream flushes the stream and waits for the flush to complete.
+func (w *bodyWriter) flushStream() error {
+	if w.stream == cm.ResourceNone || w.err != nil {
+		return w.err
+	}
+	if pastDeadline(w.deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	res := w.stream.Flush()
+	if res.IsErr() {
+		return w.flushError(*res.Err())
+	}
+	for {
+		// check-write returns a non-zero budget once the flush completes.
+		budget, serr, isErr := w.stream.CheckWrite().Result()
+		if isErr {
+			return w.flushError(serr)
+		}
+		if budget > 0 {
+			return nil
+		}
+		if err := w.wait(); err != nil {
+			return err
+		}
+	}
+}
+
+// wait blocks until the stream is ready for writing, w.deadline passes, or w.ctx is done.
+func (w *bodyWriter) wait() error {
+	poll := w.stream.Subscribe()
+	defer poll.ResourceDrop()
+	return await(w.ctx, poll, w.deadline)
+}
+
+// streamError records and returns an error for a failed write.
+// Subsequent writes will return the same error.
+func (w *bodyWriter) streamError(err streams.StreamError) error {
+	if err.Closed() {
+		w.err = errBodyClosed
+		if w.closed != nil {
+			w.closed()
+		}
+	} else {
+		w.err = errors.New("wasihttp: " + streamErrorString(err))
+	}
+	return w.err
+}
+
+// flushError is like streamError, but is used when all data has been written.
+func (w *bodyWriter) flushError(err streams.StreamError) error {
+	// The stream can be closed as soon as the planned "Content-Length" data
+	// has been flushed on the stream. But in wasmtime, after each flush we
+	// check if we can write to the stream. This can sometimes throw "closed"
+	// stream error.
+	//
+	// Refer to https://github.com/WebAssembly/wasi-io/issues/109 for more details.
+	// No data was refused, so w.closed is not called.
+	if err.Closed() {
+		return nil
+	}
+	return w.streamError(err)
+}
+
 func (w *bodyWriter) finish() error {
 	if w.finished {
 		return nil
 	}
+	err := w.flush()
 	w.finished = true
-	if w.stream != cm.ResourceNone {
-		w.stream.Flush()
-		w.stream.ResourceDrop()
-	}
+	w.dropStream()
 
 	var trailers cm.Option[types.Trailers]
+	var trailerErr error
 	if w.trailer != nil {
-		trailers = toTrailers(w.trailer())
+		trailers, trailerErr = toTrailers(w.trailer())
 	}
 	finished := types.OutgoingBodyFinish(w.body, trailers)
+	untrack("outgoing-body")
 	if finished.IsErr() {
-		return errors.New(finished.Err().String())
+		return &Error{*finished.Err()}
+	}
+	if err == nil {
+		err = trailerErr
 	}
+	return err
+}
 
-	return nil
+// abort drops the body without finishing it, which signals the host
+// that the body is incomplete.
+func (w *bodyWriter) abort() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	w.dropStream()
+	w.body.ResourceDrop()
+	untrack("outgoing-body")
+}
+
+// dropStream drops the stream, if any.
+func (w *bodyWriter) dropStream() {
+	if w.stream != cm.ResourceNone {
+		w.stream.ResourceDrop()
+		untrack("output-stream")
+	}
 }
 
 func toScheme(s string) types.Scheme {
@@ -267,29 +960,71 @@ func toMethod(s string) types.Method {
 	}
 }
 
+// fromFields takes ownership of f, and returns its contents as an [http.Header].
+// The fields are dropped after they are read.
 func fromFields(f types.Fields) http.Header {
 	h := http.Header{}
 	for _, e := range f.Entries().Slice() {
 		h.Add(string(e.F0), string(e.F1.Slice()))
 	}
+	f.ResourceDrop()
 	return h
 }
 
-func toFields(h http.Header) types.Fields {
+// toFields returns a new [types.Fields] with the contents of h, omitting
+// hop-by-hop header fields. If the host rejects any header fields, toFields
+// returns the remaining fields and a [*HeaderError] listing the rejected fields.
+func toFields(h http.Header) (types.Fields, error) {
 	fields := types.NewFields()
+	hop := hopHeaders(h)
+	var rejected []FieldError
 	for k, v := range h {
+		if hop[http.CanonicalHeaderKey(k)] {
+			continue
+		}
 		vals := make([]types.FieldValue, 0, len(v))
 		for _, vv := range v {
 			vals = append(vals, types.FieldValue(cm.ToList([]uint8(vv))))
 		}
-		fields.Set(types.FieldKey(k), cm.ToList(vals))
+		if res := fields.Set(types.FieldKey(k), cm.ToList(vals)); res.IsErr() {
+			rejected = append(rejected, FieldError{Name: k, Reason: res.Err().String()})
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Slice(rejected, func(i, j int) bool {
+			return rejected[i].Name < rejected[j].Name
+		})
+		return fields, &HeaderError{Fields: rejected}
 	}
-	return fields
+	return fields, nil
 }
 
-func toTrailers(h http.Header) cm.Option[types.Trailers] {
+func toTrailers(h http.Header) (cm.Option[types.Trailers], error) {
 	if h == nil || len(h) == 0 {
-		return cm.None[types.Trailers]()
+		return cm.None[types.Trailers](), nil
+	}
+	fields, err := toFields(h)
+	return cm.Some(fields), err
+}
+
+// hopHeaders returns the set of hop-by-hop header fields in h, including any
+// fields named by the Connection header. Hop-by-hop fields describe a single
+// connection, which is managed by the host, and are forbidden by most hosts.
+func hopHeaders(h http.Header) map[string]bool {
+	hop := map[string]bool{
+		"Connection":        true,
+		"Keep-Alive":        true,
+		"Proxy-Connection":  true,
+		"Te":                true,
+		"Transfer-Encoding": true,
+		"Upgrade":           true,
+	}
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = textproto.TrimString(k); k != "" {
+				hop[http.CanonicalHeaderKey(k)] = true
+			}
+		}
 	}
-	return cm.Some(toFields(h))
+	return hop
 }
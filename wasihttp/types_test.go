@@ -0,0 +1,459 @@
+//go:build !wasm && !tinygo
+
+package wasihttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ydnar/wasi-http-go/internal/wasi/http/types"
+	"github.com/ydnar/wasi-http-go/internal/wasi/io/streams"
+	"go.bytecodealliance.org/cm"
+)
+
+// BenchmarkBodyWriter reports the number of output-stream write and flush
+// host calls made by bodyWriter for each Write, with and without buffering.
+func BenchmarkBodyWriter(b *testing.B) {
+	for _, size := range []int{16, 512, 8192} {
+		for _, buffer := range []int{1, defaultBufferSize} {
+			for _, flush := range []bool{false, true} {
+				name := fmt.Sprintf("write=%d/buffer=%d/flush=%t", size, buffer, flush)
+				b.Run(name, func(b *testing.B) {
+					benchmarkBodyWriter(b, size, buffer, flush)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkBodyWriter(b *testing.B, size, buffer int, flush bool) {
+	h := newFakeHost(b)
+	body, _ := h.OutgoingBody(&fakePipe{discard: true})
+	w := newBodyWriter(body, buffer, nil)
+	p := make([]byte, size)
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := w.Write(p); err != nil {
+			b.Fatal(err)
+		}
+		if flush {
+			w.Flush()
+		}
+	}
+	if err := w.finish(); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(h.Calls("output-stream.write"))/float64(b.N), "writes/op")
+	b.ReportMetric(float64(h.Calls("output-stream.flush"))/float64(b.N), "flushes/op")
+}
+
+// oldBodyReader reads a body the way bodyReader did before it was buffered:
+// each Read subscribes to the stream, blocks, drops the pollable, and reads
+// at most len(p) bytes.
+type oldBodyReader struct {
+	body   types.IncomingBody
+	stream streams.InputStream
+}
+
+func (r *oldBodyReader) Read(p []byte) (int, error) {
+	if r.stream == cm.ResourceNone {
+		r.stream, _, _ = r.body.Stream().Result()
+	}
+	poll := r.stream.Subscribe()
+	poll.Block()
+	poll.ResourceDrop()
+	list, err, isErr := r.stream.Read(uint64(len(p))).Result()
+	if isErr {
+		if err.Closed() {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("failed to read from InputStream %s", err.LastOperationFailed().ToDebugString())
+	}
+	return copy(p, list.Slice()), nil
+}
+
+func (r *oldBodyReader) Close() error {
+	if r.stream != cm.ResourceNone {
+		r.stream.ResourceDrop()
+	}
+	r.body.ResourceDrop()
+	return nil
+}
+
+// BenchmarkBodyReader compares the number of host calls made to read a body
+// with oldBodyReader and with bodyReader.
+func BenchmarkBodyReader(b *testing.B) {
+	var buf bytes.Buffer
+	for i := range 1000 {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"item %d","tags":["a","b","c"]}`+"\n", i, i)
+	}
+	data := buf.Bytes()
+
+	readers := []struct {
+		name string
+		new  func(types.IncomingBody) io.ReadCloser
+	}{
+		{"old", func(body types.IncomingBody) io.ReadCloser { return &oldBodyReader{body: body} }},
+		{"buffered", func(body types.IncomingBody) io.ReadCloser { return newBodyReader(body, func(http.Header) {}) }},
+	}
+	consumers := []struct {
+		name    string
+		consume func(io.Reader) error
+	}{
+		{"read=512", func(r io.Reader) error {
+			_, err := io.CopyBuffer(writerOnly{io.Discard}, readerOnly{r}, make([]byte, 512))
+			return err
+		}},
+		{"bufio", func(r io.Reader) error {
+			br := bufio.NewReader(r)
+			for {
+				_, err := br.ReadString('\n')
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}},
+		{"json", func(r io.Reader) error {
+			dec := json.NewDecoder(bufio.NewReader(r))
+			for {
+				var v struct {
+					ID   int
+					Name string
+					Tags []string
+				}
+				err := dec.Decode(&v)
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}},
+	}
+
+	for _, c := range consumers {
+		for _, rd := range readers {
+			b.Run(c.name+"/"+rd.name, func(b *testing.B) {
+				h := newFakeHost(b)
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for range b.N {
+					r := rd.new(h.IncomingBody(&fakePipe{buf: data, closed: true}, nil))
+					if err := c.consume(r); err != nil {
+						b.Fatal(err)
+					}
+					r.Close()
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(h.Calls("input-stream.read"))/float64(b.N), "reads/op")
+				b.ReportMetric(float64(h.Calls("input-stream.subscribe"))/float64(b.N), "subscribes/op")
+				b.ReportMetric(float64(h.Calls("poll"))/float64(b.N), "polls/op")
+			})
+		}
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		values []string
+		want   string
+	}{
+		{"missing", "X-Forwarded-For", nil, ""},
+		{"ipv4", "X-Real-IP", []string{"192.0.2.1"}, "192.0.2.1:0"},
+		{"ipv4 port", "X-Real-IP", []string{"192.0.2.1:1234"}, "192.0.2.1:1234"},
+		{"ipv6", "X-Real-IP", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+		{"ipv6 brackets", "X-Real-IP", []string{"[2001:db8::1]"}, "[2001:db8::1]:0"},
+		{"ipv6 port", "X-Real-IP", []string{"[2001:db8::1]:1234"}, "[2001:db8::1]:1234"},
+		{"list", "X-Forwarded-For", []string{"192.0.2.1, 198.51.100.2"}, "198.51.100.2:0"},
+		{"multiple", "X-Forwarded-For", []string{"192.0.2.1", "198.51.100.2"}, "198.51.100.2:0"},
+		{"forwarded", "Forwarded", []string{"for=192.0.2.1;proto=https"}, "192.0.2.1:0"},
+		{"forwarded list", "Forwarded", []string{"for=192.0.2.1, for=198.51.100.2"}, "198.51.100.2:0"},
+		{"forwarded ipv6 port", "Forwarded", []string{`for="[2001:db8::1]:1234"`}, "[2001:db8::1]:1234"},
+		{"forwarded ipv6", "Forwarded", []string{`For="[2001:db8::1]"`}, "[2001:db8::1]:0"},
+		{"forwarded no for", "Forwarded", []string{"proto=https"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for _, v := range tt.values {
+				h.Add(tt.header, v)
+			}
+			if got := remoteAddr(h, tt.header); got != tt.want {
+				t.Errorf("remoteAddr(%q): got %q, expected %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncomingLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		header  http.Header
+		want    int64
+		wantTE  []string
+		wantErr bool
+		remains http.Header // h after the call
+	}{
+		{"get", "GET", http.Header{}, 0, nil, false, http.Header{}},
+		{"post", "POST", http.Header{}, -1, nil, false, http.Header{}},
+		{"length", "POST", http.Header{"Content-Length": {"5"}}, 5, nil, false, http.Header{"Content-Length": {"5"}}},
+		{"identical lengths", "POST", http.Header{"Content-Length": {"5", "5"}}, 5, nil, false, http.Header{"Content-Length": {"5", "5"}}},
+		{"conflicting lengths", "POST", http.Header{"Content-Length": {"5", "6"}}, -1, nil, true, nil},
+		{"invalid length", "POST", http.Header{"Content-Length": {"-1"}}, -1, nil, true, nil},
+		{"chunked", "POST", http.Header{"Transfer-Encoding": {"chunked"}}, -1, []string{"chunked"}, false, http.Header{}},
+		{"chunked length", "POST", http.Header{"Transfer-Encoding": {"Chunked"}, "Content-Length": {"5"}}, -1, []string{"chunked"}, false, http.Header{}},
+		{"gzip", "POST", http.Header{"Transfer-Encoding": {"gzip"}}, -1, nil, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, te, err := incomingLength(tt.method, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error: %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want || !slices.Equal(te, tt.wantTE) {
+				t.Errorf("got %d, %q, expected %d, %q", got, te, tt.want, tt.wantTE)
+			}
+			if !reflect.DeepEqual(tt.header, tt.remains) {
+				t.Errorf("got header %v, expected %v", tt.header, tt.remains)
+			}
+		})
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{200, "200 OK"},
+		{404, "404 Not Found"},
+		{418, "418 I'm a teapot"},
+		{299, "299"},
+		{999, "999"},
+	}
+	for _, tt := range tests {
+		if got := responseStatus(tt.code); got != tt.want {
+			t.Errorf("responseStatus(%d): got %q, expected %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestResponseLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		code    int
+		header  http.Header
+		want    int64
+		wantTE  []string
+		wantErr bool
+		remains http.Header // h after the call
+	}{
+		{"unknown", "GET", 200, http.Header{}, -1, nil, false, http.Header{}},
+		{"length", "GET", 200, http.Header{"Content-Length": {"5"}}, 5, nil, false, http.Header{"Content-Length": {"5"}}},
+		{"conflicting lengths", "GET", 200, http.Header{"Content-Length": {"5", "6"}}, -1, nil, true, nil},
+		{"invalid length", "GET", 200, http.Header{"Content-Length": {"x"}}, -1, nil, true, nil},
+		{"chunked", "GET", 200, http.Header{"Transfer-Encoding": {"chunked"}, "Content-Length": {"5"}}, -1, []string{"chunked"}, false, http.Header{}},
+		{"gzip", "GET", 200, http.Header{"Transfer-Encoding": {"gzip"}}, -1, nil, true, nil},
+		{"head", "HEAD", 200, http.Header{"Content-Length": {"5"}}, 5, nil, false, http.Header{"Content-Length": {"5"}}},
+		{"head invalid length", "HEAD", 200, http.Header{"Content-Length": {"x"}}, -1, nil, false, http.Header{"Content-Length": {"x"}}},
+		{"head chunked", "HEAD", 200, http.Header{"Transfer-Encoding": {"chunked"}}, -1, nil, false, http.Header{"Transfer-Encoding": {"chunked"}}},
+		{"1xx", "GET", 101, http.Header{"Content-Length": {"5"}}, 0, nil, false, http.Header{"Content-Length": {"5"}}},
+		{"204", "GET", 204, http.Header{}, 0, nil, false, http.Header{}},
+		{"304", "GET", 304, http.Header{"Content-Length": {"5"}}, 0, nil, false, http.Header{"Content-Length": {"5"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, te, err := responseLength(tt.method, tt.code, tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, expected error: %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want || !slices.Equal(te, tt.wantTE) {
+				t.Errorf("got %d, %q, expected %d, %q", got, te, tt.want, tt.wantTE)
+			}
+			if !reflect.DeepEqual(tt.header, tt.remains) {
+				t.Errorf("got header %v, expected %v", tt.header, tt.remains)
+			}
+		})
+	}
+}
+
+func TestHeaderHasToken(t *testing.T) {
+	tests := []struct {
+		values []string
+		token  string
+		want   bool
+	}{
+		{nil, "close", false},
+		{[]string{"close"}, "close", true},
+		{[]string{"Close"}, "close", true},
+		{[]string{"keep-alive, close"}, "close", true},
+		{[]string{"keep-alive", " close "}, "close", true},
+		{[]string{"closed"}, "close", false},
+		{[]string{"keep-alive"}, "close", false},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Connection": tt.values}
+		if got := headerHasToken(h, "Connection", tt.token); got != tt.want {
+			t.Errorf("headerHasToken(%q, %q): got %t, expected %t", tt.values, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	// Data buffered in the reader and the writer is written before the rest
+	// of the input is spliced by the host.
+	t.Run("buffered", func(t *testing.T) {
+		h := newFakeHost(t)
+		in := &fakePipe{buf: []byte("hello ")}
+		r := newBodyReader(h.IncomingBody(in, nil), func(http.Header) {})
+		if c, err := r.ReadByte(); err != nil || c != 'h' {
+			t.Fatalf("ReadByte: got %q, %v", c, err)
+		}
+		h.Write(in, []byte("world"))
+		h.Close(in)
+		out, ob := h.OutgoingBody(&fakePipe{})
+		w := newBodyWriter(out, 0, nil)
+		w.Write([]byte("> "))
+		n, err := w.ReadFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len("ello world")) {
+			t.Errorf("got n=%d, expected %d", n, len("ello world"))
+		}
+		if err := w.finish(); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(h.Body(ob)), "> ello world"; got != want {
+			t.Errorf("got %q, expected %q", got, want)
+		}
+		if h.Calls("output-stream.splice") == 0 {
+			t.Error("input was not spliced")
+		}
+	})
+
+	t.Run("EOF with trailers", func(t *testing.T) {
+		h := newFakeHost(t)
+		in := &fakePipe{buf: []byte("body"), closed: true}
+		var trailer http.Header
+		r := newBodyReader(h.IncomingBody(in, http.Header{"X-Checksum": {"abc"}}), func(h http.Header) { trailer = h })
+		out, ob := h.OutgoingBody(&fakePipe{})
+		w := newBodyWriter(out, 0, nil)
+		if _, err := r.WriteTo(w); err != nil {
+			t.Fatal(err)
+		}
+		w.finish()
+		if got, want := string(h.Body(ob)), "body"; got != want {
+			t.Errorf("got %q, expected %q", got, want)
+		}
+		if got, want := trailer, (http.Header{"X-Checksum": {"abc"}}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got trailer %v, expected %v", got, want)
+		}
+		if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read after splice: got %v, expected %v", err, io.EOF)
+		}
+	})
+
+	// The host closes the output stream once Content-Length bytes are
+	// written, before the input reports EOF. No data was refused.
+	t.Run("closed at length", func(t *testing.T) {
+		h := newFakeHost(t)
+		in := &fakePipe{buf: []byte("0123456789")}
+		r := newBodyReader(h.IncomingBody(in, nil), func(http.Header) {})
+		out, _ := h.OutgoingBody(&fakePipe{size: 10})
+		w := newBodyWriter(out, 0, nil)
+		var closed bool
+		w.closed = func() { closed = true }
+		go func() {
+			time.Sleep(time.Millisecond)
+			h.Close(in)
+		}()
+		n, err := w.ReadFrom(r)
+		if n != 10 || err != nil {
+			t.Errorf("got %d, %v, expected 10, nil", n, err)
+		}
+		if closed {
+			t.Error("closed called, but no data was refused")
+		}
+		if err := w.finish(); err != nil {
+			t.Errorf("finish: got %v, expected nil", err)
+		}
+	})
+
+	// The output stream is closed before all of the input is written.
+	t.Run("closed first", func(t *testing.T) {
+		h := newFakeHost(t)
+		in := &fakePipe{buf: []byte("0123456789abcdef"), closed: true}
+		r := newBodyReader(h.IncomingBody(in, nil), func(http.Header) {})
+		out, _ := h.OutgoingBody(&fakePipe{size: 10})
+		w := newBodyWriter(out, 0, nil)
+		var closed bool
+		w.closed = func() { closed = true }
+		n, err := w.ReadFrom(r)
+		if n != 10 || err != errBodyClosed {
+			t.Errorf("got %d, %v, expected 10, %v", n, err, errBodyClosed)
+		}
+		if !closed {
+			t.Error("closed not called")
+		}
+		w.abort()
+		rest, err := io.ReadAll(r)
+		if err != nil || string(rest) != "abcdef" {
+			t.Errorf("rest of input: got %q, %v, expected %q", rest, err, "abcdef")
+		}
+	})
+
+	// A Server handler copies a Transport response body to its response.
+	t.Run("response to response", func(t *testing.T) {
+		h := newFakeHost(t)
+		body := strings.Repeat("x", 4*sniffLen)
+		h.onRequest = func(r *fakeOutgoingRequest, f *fakeFuture) {
+			h.Respond(f, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, body)
+		}
+		s := &Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, _ := http.NewRequest("GET", "http://upstream.example/", nil)
+			res, err := new(Transport).RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer res.Body.Close()
+			if _, err := io.Copy(w, res.Body); err != nil {
+				t.Error(err)
+			}
+		})}
+		res := fakeServe(h, s, httptest.NewRequest("GET", "http://example.com/", nil))
+		if res.Body != body || !res.Finished {
+			t.Errorf("got %d bytes, finished=%t, expected %d bytes, finished", len(res.Body), res.Finished, len(body))
+		}
+		if h.Calls("output-stream.splice") == 0 {
+			t.Error("response body was not spliced")
+		}
+	})
+}